@@ -0,0 +1,46 @@
+package admin
+
+import (
+	"Akash/core"
+	"Akash/logging"
+	"encoding/json"
+	"net/http"
+)
+
+type readiness struct {
+	Ready    bool `json:"ready"`
+	Routable int  `json:"routable"`
+	Total    int  `json:"total"`
+}
+
+// RegisterHandlers mounts the admin endpoints for lb on mux.
+func RegisterHandlers(mux *http.ServeMux, lb *core.LoadBalancer) {
+	mux.HandleFunc("/backends", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, lb.Snapshot())
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		routable, total := lb.RoutableCount()
+		status := http.StatusOK
+		if routable == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, readiness{
+			Ready:    routable > 0,
+			Routable: routable,
+			Total:    total,
+		})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Warnf("Failed to write admin response: %v", err)
+	}
+}
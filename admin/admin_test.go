@@ -0,0 +1,79 @@
+package admin
+
+import (
+	"Akash/core"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func readyz(t *testing.T, lb *core.LoadBalancer) (int, readiness) {
+	t.Helper()
+	mux := http.NewServeMux()
+	RegisterHandlers(mux, lb)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var ready readiness
+	if err := json.NewDecoder(rec.Body).Decode(&ready); err != nil {
+		t.Fatal(err)
+	}
+	return rec.Code, ready
+}
+
+// TestReadyzCountsRoutableBackends checks that a backend whose probe passes
+// but which takes no new connections, because it is draining, at its
+// max_conns or weighted out, doesn't count towards readiness.
+func TestReadyzCountsRoutableBackends(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Draining", "1")
+	}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+
+	tests := []struct {
+		name  string
+		cfg   *core.UserConfig
+		setup func(lb *core.LoadBalancer)
+		ready bool
+	}{
+		{"routable", &core.UserConfig{}, func(lb *core.LoadBalancer) {}, true},
+		{"draining", &core.UserConfig{HealthCheckPath: "/health", HealthCheckDrainHeader: "X-Draining", WarmupConcurrency: 1}, func(lb *core.LoadBalancer) {
+			core.Warmup(context.Background(), lb)
+		}, false},
+		{"at max_conns", &core.UserConfig{}, func(lb *core.LoadBalancer) {
+			lb.Pool().Backends[0].SetMaxConns(1)
+			lb.GetNextBackend("10.0.0.1:1", "/")
+		}, false},
+		{"weight zero under w_round_robin", &core.UserConfig{Algorithm: "w_round_robin"}, func(lb *core.LoadBalancer) {
+			lb.Pool().Backends[0].SetWeight(0)
+		}, false},
+		{"weight zero outside w_round_robin", &core.UserConfig{}, func(lb *core.LoadBalancer) {
+			lb.Pool().Backends[0].SetWeight(0)
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := &core.LoadBalancer{}
+			if tt.cfg.Algorithm == "" {
+				tt.cfg.Algorithm = "round_robin"
+			}
+			lb.SetPool(tt.cfg, []*core.Backend{core.NewBackend(&core.Backend{Address: addr})})
+			tt.setup(lb)
+
+			code, ready := readyz(t, lb)
+			wantCode, wantRoutable := http.StatusOK, 1
+			if !tt.ready {
+				wantCode, wantRoutable = http.StatusServiceUnavailable, 0
+			}
+			if code != wantCode || ready.Ready != tt.ready || ready.Routable != wantRoutable || ready.Total != 1 {
+				t.Fatalf("/readyz = %d %+v, want %d with %d/1 routable", code, ready, wantCode, wantRoutable)
+			}
+			if !lb.Pool().Backends[0].IsHealthy {
+				t.Fatal("backend is not healthy, so readiness isn't about routability")
+			}
+		})
+	}
+}
@@ -0,0 +1,26 @@
+package admin
+
+import (
+	"Akash/logging"
+	"net/http"
+	"net/http/pprof"
+)
+
+// StartPprofServer serves the net/http/pprof handlers on addr. They get a
+// mux of their own so profiling is never reachable through the metrics or
+// proxy listeners.
+func StartPprofServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		logging.Infof("pprof available at %s/debug/pprof/", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logging.Errorf("pprof server error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,57 @@
+package admin
+
+import (
+	"Akash/core"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPprofServer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	StartPprofServer(addr)
+
+	get := func(path string) int {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := http.Get("http://" + addr + path)
+			if err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("pprof server never answered: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline", "/debug/pprof/goroutine?debug=1"} {
+		if code := get(path); code != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, code)
+		}
+	}
+}
+
+// TestPprofNotOnAdminMux checks that without pprof_addr the profiling
+// handlers are not reachable through the admin endpoints.
+func TestPprofNotOnAdminMux(t *testing.T) {
+	mux := http.NewServeMux()
+	lb := &core.LoadBalancer{}
+	lb.SetPool(&core.UserConfig{Algorithm: "round_robin"}, nil)
+	RegisterHandlers(mux, lb)
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/cmdline"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("GET %s on the admin mux = %d, want 404", path, rec.Code)
+		}
+	}
+}
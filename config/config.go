@@ -3,19 +3,159 @@ package config
 import (
 	core "Akash/core"
 	"encoding/json"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+// LoadConfig reads and validates the config at path. Every error it returns
+// is a *ConfigError.
 func LoadConfig(path string) (*core.UserConfig, error) {
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, err
+		return nil, readError(path, err)
 	}
-	defer file.Close()
 
 	var Config core.UserConfig
-	if err := json.NewDecoder(file).Decode(&Config); err != nil {
+	if err := json.Unmarshal(data, &Config); err != nil {
+		return nil, decodeError(path, data, err)
+	}
+
+	if Config.BackendsFile != "" {
+		backendsPath := Config.BackendsFile
+		if !filepath.IsAbs(backendsPath) {
+			backendsPath = filepath.Join(filepath.Dir(path), backendsPath)
+		}
+		backends, err := loadBackendsFile(backendsPath)
+		if err != nil {
+			return nil, err
+		}
+		Config.Backends = append(Config.Backends, backends...)
+	}
+
+	if err := validate(path, &Config); err != nil {
 		return nil, err
 	}
 	return &Config, nil
 }
+
+// loadBackendsFile reads a JSON array of backends from path.
+func loadBackendsFile(path string) ([]*core.Backend, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, readError(path, err)
+	}
+
+	var backends []*core.Backend
+	if err := json.Unmarshal(data, &backends); err != nil {
+		return nil, decodeError(path, data, err)
+	}
+	return backends, nil
+}
+
+// validate checks and normalizes a decoded config.
+func validate(path string, cfg *core.UserConfig) error {
+	// serving plaintext because half the TLS config is missing would expose
+	// a service that is expected to be encrypted
+	if cfg.TLSCertFile != "" && cfg.TLSKeyFile == "" {
+		return invalid(path, "tls_key_file", "required when tls_cert_file is set")
+	}
+	if cfg.TLSKeyFile != "" && cfg.TLSCertFile == "" {
+		return invalid(path, "tls_cert_file", "required when tls_key_file is set")
+	}
+
+	switch cfg.BufferPool {
+	case "", "single", "tiered":
+	default:
+		return invalid(path, "buffer_pool", "unknown buffer pool %q (want single or tiered)", cfg.BufferPool)
+	}
+
+	if err := normalizeAddresses(path, cfg); err != nil {
+		return err
+	}
+	return dedupeBackends(path, cfg)
+}
+
+// schemePorts are the backend address schemes Akash understands and the
+// port each implies when the address has none.
+var schemePorts = map[string]string{
+	"tcp":   "",
+	"http":  "80",
+	"https": "443",
+}
+
+// normalizeAddresses makes sure every backend address is host:port. A
+// tcp://, http:// or https:// prefix is stripped, with https:// turning on
+// TLS to the backend. An address without a port gets the scheme's port or
+// default_backend_port and is rejected otherwise, rather than failing every
+// dial and health check.
+func normalizeAddresses(path string, cfg *core.UserConfig) error {
+	for _, backend := range cfg.Backends {
+		if backend == nil {
+			return invalid(path, "Backends", "backend entry must not be null")
+		}
+
+		original := backend.Address
+		defaultPort := cfg.DefaultBackendPort
+		if scheme, rest, ok := strings.Cut(backend.Address, "://"); ok {
+			port, known := schemePorts[strings.ToLower(scheme)]
+			if !known {
+				return invalid(path, "Backends", "backend address %q has unsupported scheme %q (want tcp, http or https)", backend.Address, scheme)
+			}
+			rest = strings.TrimSuffix(rest, "/")
+			if strings.Contains(rest, "/") {
+				return invalid(path, "Backends", "backend address %q must not have a path", backend.Address)
+			}
+			if strings.EqualFold(scheme, "https") {
+				backend.TLS = true
+			}
+			if port != "" {
+				defaultPort = port
+			}
+			backend.Address = rest
+		}
+
+		host, port, err := net.SplitHostPort(backend.Address)
+		if err == nil {
+			if host == "" || port == "" {
+				return invalid(path, "Backends", "backend address %q must be host:port", original)
+			}
+			continue
+		}
+
+		// a bare IPv6 address is full of colons but still has no port
+		host = strings.TrimSuffix(strings.TrimPrefix(backend.Address, "["), "]")
+		if host == "" || (strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+			return invalid(path, "Backends", "backend address %q must be host:port", original)
+		}
+		if defaultPort == "" {
+			return invalid(path, "Backends", "backend address %q has no port (add one or set default_backend_port)", original)
+		}
+		backend.Address = net.JoinHostPort(host, defaultPort)
+	}
+	return nil
+}
+
+// dedupeBackends handles backends listed more than once. With
+// allow_duplicate_backends set, duplicates are merged into the first entry
+// by summing weights and combining paths; otherwise they are rejected.
+func dedupeBackends(path string, cfg *core.UserConfig) error {
+	byAddress := make(map[string]*core.Backend, len(cfg.Backends))
+	merged := make([]*core.Backend, 0, len(cfg.Backends))
+	for _, backend := range cfg.Backends {
+		first, ok := byAddress[backend.Address]
+		if !ok {
+			byAddress[backend.Address] = backend
+			merged = append(merged, backend)
+			continue
+		}
+		if !cfg.AllowDuplicateBackends {
+			return invalid(path, "Backends", "duplicate backend address %s (set allow_duplicate_backends to merge duplicates)", backend.Address)
+		}
+		first.Weight += backend.Weight
+		first.Paths = append(first.Paths, backend.Paths...)
+	}
+	cfg.Backends = merged
+	return nil
+}
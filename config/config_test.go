@@ -0,0 +1,174 @@
+package config
+
+import (
+	"Akash/core"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestWeightsReportedAfterLoad loads a weighted round robin config and
+// checks the configured and current weights the admin API and the
+// akash_backend_weight gauge read from Snapshot.
+func TestWeightsReportedAfterLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "akash.json")
+	// weights 0, 1 and 2
+	writeConfig(t, path, "w_round_robin", 3)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]*core.Backend, 0, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		backends = append(backends, core.NewBackend(b))
+	}
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, backends)
+
+	_, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+	release()
+
+	// one smooth weighted round robin pick: 1 and 2 are added, the
+	// heavier backend wins and gives back the total of 3
+	want := []struct{ weight, current int }{{0, 0}, {1, 1}, {2, -1}}
+	statuses := lb.Snapshot()
+	for i, status := range statuses {
+		if status.Weight != want[i].weight || status.CurrentWeight != want[i].current {
+			t.Errorf("%s: weight %d current %d, want %d and %d", status.Address, status.Weight, status.CurrentWeight, want[i].weight, want[i].current)
+		}
+	}
+
+	data, err := json.Marshal(statuses[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"weight":2`) || !strings.Contains(string(data), `"current_weight":-1`) {
+		t.Fatalf("admin JSON %s is missing the weights", data)
+	}
+}
+
+// TestBackendsFile loads backends from an included file next to the config,
+// rejects an address listed in both files and picks up edits on reload.
+func TestBackendsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "akash.json")
+	included := filepath.Join(dir, "backends.json")
+	writeFile(t, path, `{"listen": "0", "log_level": "error", "backends_file": "backends.json", "Backends": [{"address": "10.0.0.1:80"}]}`)
+	writeFile(t, included, `[{"address": "10.0.0.2:80"}, {"address": "10.0.0.3:80"}]`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := addresses(cfg.Backends); got != "10.0.0.1:80 10.0.0.2:80 10.0.0.3:80" {
+		t.Fatalf("loaded backends %s, want the inline one and both included ones", got)
+	}
+
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, nil)
+	writeFile(t, included, `[{"address": "10.0.0.4:80"}]`)
+	ReloadConfig(lb, path)
+	if got := addresses(lb.Pool().Backends); got != "10.0.0.1:80 10.0.0.4:80" {
+		t.Fatalf("backends after reload %s, want the edited included file", got)
+	}
+
+	writeFile(t, included, `[{"address": "10.0.0.1:80"}]`)
+	var cerr *ConfigError
+	if _, err := LoadConfig(path); !errors.As(err, &cerr) || cerr.Kind != KindValidation || !strings.Contains(err.Error(), "duplicate") {
+		t.Fatalf("LoadConfig with an address in both files returned %v, want a duplicate error", err)
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addresses(backends []*core.Backend) string {
+	list := make([]string, 0, len(backends))
+	for _, b := range backends {
+		list = append(list, b.Address)
+	}
+	return strings.Join(list, " ")
+}
+
+func TestDuplicateBackends(t *testing.T) {
+	backends := `"Backends": [{"address": "10.0.0.1:80", "weight": 2, "paths": ["/a"]}, {"address": "10.0.0.2:80", "weight": 1}, {"address": "10.0.0.1:80", "weight": 3, "paths": ["/b"]}]`
+
+	t.Run("merged", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "akash.json")
+		writeFile(t, path, `{"allow_duplicate_backends": true, `+backends+`}`)
+		cfg, err := LoadConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := addresses(cfg.Backends); got != "10.0.0.1:80 10.0.0.2:80" {
+			t.Fatalf("backends %s, want the duplicate merged into the first entry", got)
+		}
+		merged := cfg.Backends[0]
+		if merged.Weight != 5 || strings.Join(merged.Paths, " ") != "/a /b" {
+			t.Fatalf("merged backend has weight %d and paths %v, want 5 and [/a /b]", merged.Weight, merged.Paths)
+		}
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "akash.json")
+		writeFile(t, path, `{`+backends+`}`)
+		_, err := LoadConfig(path)
+		var cerr *ConfigError
+		if !errors.As(err, &cerr) || cerr.Kind != KindValidation || !strings.Contains(err.Error(), "duplicate backend address 10.0.0.1:80") {
+			t.Fatalf("LoadConfig returned %v, want a duplicate backend error", err)
+		}
+	})
+}
+
+func TestBackendAddressPorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    string
+		wantTLS bool
+		wantErr string
+	}{
+		{"default port applied", `{"default_backend_port": "8080", "Backends": [{"address": "10.0.0.1"}]}`, "10.0.0.1:8080", false, ""},
+		{"explicit port kept", `{"default_backend_port": "8080", "Backends": [{"address": "10.0.0.1:9000"}]}`, "10.0.0.1:9000", false, ""},
+		{"bare IPv6", `{"default_backend_port": "8080", "Backends": [{"address": "::1"}]}`, "[::1]:8080", false, ""},
+		{"tcp scheme", `{"Backends": [{"address": "tcp://10.0.0.1:9000"}]}`, "10.0.0.1:9000", false, ""},
+		{"tcp scheme has no default port", `{"Backends": [{"address": "tcp://10.0.0.1"}]}`, "", false, `backend address "tcp://10.0.0.1" has no port`},
+		{"http scheme port", `{"Backends": [{"address": "http://api.internal"}]}`, "api.internal:80", false, ""},
+		{"https scheme port", `{"Backends": [{"address": "https://api.internal"}]}`, "api.internal:443", true, ""},
+		{"https explicit port", `{"Backends": [{"address": "HTTPS://api.internal:8443/"}]}`, "api.internal:8443", true, ""},
+		{"unknown scheme", `{"Backends": [{"address": "ftp://api.internal"}]}`, "", false, `backend address "ftp://api.internal" has unsupported scheme "ftp"`},
+		{"scheme with path", `{"Backends": [{"address": "http://api.internal/v1"}]}`, "", false, `backend address "http://api.internal/v1" must not have a path`},
+		{"no port", `{"Backends": [{"address": "10.0.0.1"}]}`, "", false, `backend address "10.0.0.1" has no port (add one or set default_backend_port)`},
+		{"empty port", `{"Backends": [{"address": "10.0.0.1:"}]}`, "", false, `backend address "10.0.0.1:" must be host:port`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "akash.json")
+			writeFile(t, path, tt.config)
+			cfg, err := LoadConfig(path)
+			if tt.wantErr != "" {
+				var cerr *ConfigError
+				if !errors.As(err, &cerr) || cerr.Kind != KindValidation || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("LoadConfig returned %v, want a validation error %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.Backends[0].Address; got != tt.want {
+				t.Fatalf("address %q, want %q", got, tt.want)
+			}
+			if got := cfg.Backends[0].TLS; got != tt.wantTLS {
+				t.Fatalf("tls %v, want %v", got, tt.wantTLS)
+			}
+		})
+	}
+}
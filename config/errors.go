@@ -0,0 +1,164 @@
+package config
+
+import (
+	core "Akash/core"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"reflect"
+	"strings"
+)
+
+// ErrorKind tells apart the ways loading a config can fail.
+type ErrorKind int
+
+const (
+	// KindNotFound means the config (or an included) file does not exist.
+	KindNotFound ErrorKind = iota
+	// KindUnreadable means the file exists but could not be read.
+	KindUnreadable
+	// KindInvalidJSON means the file is not valid JSON or a value has the
+	// wrong type for its field.
+	KindInvalidJSON
+	// KindValidation means the file parsed but its contents are not usable.
+	KindValidation
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindNotFound:
+		return "not found"
+	case KindUnreadable:
+		return "unreadable"
+	case KindInvalidJSON:
+		return "invalid JSON"
+	default:
+		return "invalid config"
+	}
+}
+
+// ConfigError is returned by LoadConfig for every failure. Field, Line and
+// Column are set when they are known.
+type ConfigError struct {
+	Kind   ErrorKind
+	Path   string
+	Field  string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *ConfigError) Error() string {
+	msg := e.Path
+	if e.Line > 0 {
+		msg += fmt.Sprintf(":%d:%d", e.Line, e.Column)
+	}
+	msg += ": " + e.Kind.String()
+	if e.Field != "" {
+		msg += ": field " + e.Field
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// readError classifies an error from reading a config file.
+func readError(path string, err error) *ConfigError {
+	kind := KindUnreadable
+	if errors.Is(err, fs.ErrNotExist) {
+		kind = KindNotFound
+	}
+	return &ConfigError{Kind: kind, Path: path, Err: err}
+}
+
+// decodeError turns a JSON decode error into a ConfigError pointing at the
+// line, column and field of the problem where the decoder reports them.
+func decodeError(path string, data []byte, err error) *ConfigError {
+	cerr := &ConfigError{Kind: KindInvalidJSON, Path: path, Err: err}
+
+	var offset int64 = -1
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		offset = syntaxErr.Offset
+	case errors.As(err, &typeErr):
+		offset = typeErr.Offset
+		cerr.Field = typeErr.Field
+		expected := typeErr.Type.String()
+		if typeErr.Type == durationType {
+			expected = `a duration ("250ms", "2s") or a number of seconds`
+			if field, at := invalidDuration(data); at >= 0 {
+				cerr.Field, offset = field, at
+			}
+		}
+		cerr.Err = fmt.Errorf("expected %s, got JSON %s", expected, typeErr.Value)
+	}
+
+	if offset >= 0 && offset <= int64(len(data)) {
+		before := data[:offset]
+		cerr.Line = bytes.Count(before, []byte("\n")) + 1
+		cerr.Column = int(offset) - (bytes.LastIndexByte(before, '\n') + 1) + 1
+	}
+	return cerr
+}
+
+var durationType = reflect.TypeOf(core.Duration(0))
+
+// invalidDuration finds the first top-level field of data that is a
+// core.Duration in UserConfig and doesn't decode as one, returning its name
+// and the offset of its value, or -1 if there is none. Depending on the Go
+// version, encoding/json reports neither for an error from UnmarshalJSON.
+func invalidDuration(data []byte) (string, int64) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return "", -1
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", -1
+		}
+		key, _ := tok.(string)
+		// skip the colon and whitespace up to the value
+		offset := dec.InputOffset()
+		for offset < int64(len(data)) && strings.IndexByte(" \t\r\n:", data[offset]) >= 0 {
+			offset++
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return "", -1
+		}
+		if !isDurationField(key) {
+			continue
+		}
+		var d core.Duration
+		if err := d.UnmarshalJSON(raw); err != nil {
+			return key, offset
+		}
+	}
+	return "", -1
+}
+
+// isDurationField reports whether the UserConfig field decoded from key is
+// a core.Duration, matching keys the way encoding/json does.
+func isDurationField(key string) bool {
+	t := reflect.TypeOf(core.UserConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if f.Type == durationType && strings.EqualFold(name, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// invalid returns a validation error for field.
+func invalid(path, field, format string, args ...interface{}) *ConfigError {
+	return &ConfigError{Kind: KindValidation, Path: path, Field: field, Err: fmt.Errorf(format, args...)}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigErrorKinds(t *testing.T) {
+	backends := `"Backends": [{"address": "127.0.0.1:8080"}]`
+	tests := []struct {
+		name       string
+		config     string // "" leaves the file missing
+		unreadable bool
+		kind       ErrorKind
+		field      string
+		line, col  int
+		contains   string
+	}{
+		{name: "missing file", kind: KindNotFound},
+		{name: "unreadable", config: "{}", unreadable: true, kind: KindUnreadable},
+		{name: "syntax error", config: "{\n  \"listen\": \"1902\",\n}", kind: KindInvalidJSON, line: 3, col: 2},
+		{name: "wrong type", config: "{\n  \"max_connections\": \"many\"\n}", kind: KindInvalidJSON, field: "max_connections", line: 2, col: 28},
+		{name: "bad duration string", config: "{\n  \"listen\": \"1902\",\n  \"timeout\": \"abc\"\n}", kind: KindInvalidJSON, field: "timeout", line: 3, col: 14, contains: `string "abc"`},
+		{name: "bad duration type", config: "{\"health_check_interval\": true, " + backends + "}", kind: KindInvalidJSON, field: "health_check_interval", line: 1, col: 27, contains: "a duration"},
+		{name: "validation", config: "{\"buffer_pool\": \"huge\", " + backends + "}", kind: KindValidation, field: "buffer_pool"},
+		{name: "tls cert without key", config: "{\"tls_cert_file\": \"cert.pem\", " + backends + "}", kind: KindValidation, field: "tls_key_file", contains: "required when tls_cert_file is set"},
+		{name: "tls key without cert", config: "{\"tls_key_file\": \"key.pem\", " + backends + "}", kind: KindValidation, field: "tls_cert_file", contains: "required when tls_key_file is set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "akash.json")
+			if tt.config != "" {
+				if err := os.WriteFile(path, []byte(tt.config), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.unreadable {
+				// a directory can't be read as a file, even by root
+				path = t.TempDir()
+			}
+
+			_, err := LoadConfig(path)
+			var cerr *ConfigError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("LoadConfig error %v is not a *ConfigError", err)
+			}
+			if cerr.Kind != tt.kind {
+				t.Errorf("kind %s, want %s (%v)", cerr.Kind, tt.kind, err)
+			}
+			if cerr.Field != tt.field {
+				t.Errorf("field %q, want %q (%v)", cerr.Field, tt.field, err)
+			}
+			if cerr.Line != tt.line || cerr.Column != tt.col {
+				t.Errorf("position %d:%d, want %d:%d (%v)", cerr.Line, cerr.Column, tt.line, tt.col, err)
+			}
+			if !strings.Contains(err.Error(), tt.contains) {
+				t.Errorf("error %q does not mention %q", err, tt.contains)
+			}
+		})
+	}
+}
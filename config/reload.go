@@ -2,57 +2,77 @@ package config
 
 import (
 	core "Akash/core"
+	"Akash/logging"
+	"Akash/metrics"
 	"crypto/tls"
-	"log"
+	"fmt"
 	"sync/atomic"
 )
 
-var currentTLSConfig atomic.Value
+// CurrentTLSCert holds the *tls.Certificate served by the TLS listener;
+// ReloadConfig swaps it when the certificate files change.
+var CurrentTLSCert atomic.Value
+
+// GetCertificate returns the tls.Config callback that serves CurrentTLSCert,
+// rejecting handshakes for server names lb's config doesn't allow.
+func GetCertificate(lb *core.LoadBalancer) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if !lb.Config().AllowsSNI(hello.ServerName) {
+			return nil, fmt.Errorf("server name %q not allowed", hello.ServerName)
+		}
+		return CurrentTLSCert.Load().(*tls.Certificate), nil
+	}
+}
 
 func ReloadConfig(lb *core.LoadBalancer, configPath string) {
-	log.Println("Reloading configuration...")
+	logging.Infof("Reloading configuration...")
 
 	cfg, err := LoadConfig(configPath)
 	if err != nil {
-		log.Printf("Failed to reload config: %v", err)
+		logging.Errorf("Failed to reload config: %v", err)
 		return
 	}
 
 	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
 		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
 		if err != nil {
-			log.Printf("Failed to reload TLS certs: %v", err)
+			logging.Errorf("Failed to reload TLS certs: %v", err)
 		} else {
-			currentTLSConfig.Store(&cert)
-			log.Println("🔒 TLS certs reloaded")
+			CurrentTLSCert.Store(&cert)
+			logging.Infof("🔒 TLS certs reloaded")
 		}
 	}
 
-	lb.Algo = core.ParseAlgorithm(cfg.Algorithm)
-	lb.Config = cfg
+	if err := logging.Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+		logging.Errorf("Failed to reload logging config: %v", err)
+	}
+
+	oldBackends := lb.Pool().Backends
+	existing := make(map[string]*core.Backend, len(oldBackends))
+	for _, oldB := range oldBackends {
+		existing[oldB.Address] = oldB
+	}
 
-	var newBackends []*core.Backend
+	newBackends := make([]*core.Backend, 0, len(cfg.Backends))
 	for _, backend := range cfg.Backends {
-
-		found := false
-		for _, oldB := range lb.Backends {
-			if oldB.Address == backend.Address {
-				newBackends = append(newBackends, oldB)
-				found = true
-				break
-			}
-		}
-		if !found {
-			newBackends = append(newBackends, &core.Backend{
-				Address:   backend.Address,
-				IsHealthy: true,
-			})
+		// switching a backend to or from TLS replaces it, since
+		// connections already dial it one way or the other; moving it
+		// to another group does too, since selection reads the group
+		// without locking
+		if oldB, ok := existing[backend.Address]; ok && oldB.TLS == backend.TLS && oldB.Group == backend.Group {
+			oldB.SetPaths(backend.Paths)
+			oldB.SetWeight(backend.Weight)
+			oldB.SetMaxConns(backend.MaxConns)
+			oldB.SetHealthCheckPath(backend.HealthCheckPath)
+			newBackends = append(newBackends, oldB)
+			continue
 		}
+		newBackends = append(newBackends, core.NewBackend(backend))
 	}
-	lb.Backends = newBackends
-
-	lb.BackendCounts = make([]int32, len(lb.Backends))
-	lb.BackendFails = make([]int32, len(lb.Backends))
+	lb.SetPool(cfg, newBackends)
 
-	log.Printf("Configuration reloaded: %d backends, algorithm=%v", len(lb.Backends), lb.Algo)
+	pool := lb.Pool()
+	metrics.SetAlgorithm(pool.Algo.String())
+	metrics.EnableExemplars.Store(cfg.MetricsExemplars)
+	logging.Infof("Configuration reloaded: %d backends, algorithm=%v", len(pool.Backends), pool.Algo)
 }
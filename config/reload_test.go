@@ -0,0 +1,276 @@
+package config
+
+import (
+	"Akash/core"
+	"Akash/logging"
+	"Akash/metrics"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func writeConfig(t *testing.T, path, algorithm string, backends int) {
+	t.Helper()
+	list := ""
+	for i := 0; i < backends; i++ {
+		if i > 0 {
+			list += ","
+		}
+		list += fmt.Sprintf(`{"address": "127.0.0.1:%d", "weight": %d, "paths": ["/p%d"]}`, 20000+i, i%3, i)
+	}
+	data := fmt.Sprintf(`{"listen": "0", "algorithm": %q, "log_level": "error", "Backends": [%s]}`, algorithm, list)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestReloadUnderTraffic reloads between pools of different sizes and
+// algorithms while connections are being routed. Run with -race.
+func TestReloadUnderTraffic(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.json")
+	large := filepath.Join(dir, "large.json")
+	writeConfig(t, small, "ip_hash", 2)
+	writeConfig(t, large, "w_round_robin", 9)
+
+	cfg, err := LoadConfig(small)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]*core.Backend, 0, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		backends = append(backends, core.NewBackend(b))
+	}
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, backends)
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				client := fmt.Sprintf("10.0.%d.%d:1234", w, i%256)
+				backend, idx, release := lb.GetNextBackend(client, fmt.Sprintf("/p%d/x", i%9))
+				if backend == nil {
+					continue
+				}
+				if idx < 0 {
+					t.Errorf("selected %s with index %d", backend.Address, idx)
+				}
+				lb.Stats()
+				lb.Snapshot()
+				release()
+			}
+		}(w)
+	}
+
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			ReloadConfig(lb, large)
+		} else {
+			ReloadConfig(lb, small)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := len(lb.Pool().Backends); got != 2 {
+		t.Fatalf("pool has %d backends after the last reload, want 2", got)
+	}
+	if n := lb.ConnectionCount; n != 0 {
+		t.Fatalf("ConnectionCount = %d after all releases, want 0", n)
+	}
+}
+
+// TestReloadReplacesPathRoutes moves a backend's path route on reload and
+// checks the new route applies and the old one is gone.
+func TestReloadReplacesPathRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "akash.json")
+	routes := func(prefix string) string {
+		return fmt.Sprintf(`{"listen": "0", "algorithm": "round_robin", "log_level": "error", "Backends": [{"address": "10.0.0.1:80", "paths": [%q]}, {"address": "10.0.0.2:80"}]}`, prefix)
+	}
+	writeFile(t, path, routes("/old"))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, nil)
+	ReloadConfig(lb, path)
+
+	routed := func(path string) bool {
+		for i := 0; i < 10; i++ {
+			b, _, release := lb.GetNextBackend("10.1.0.1:1", path)
+			release()
+			if b == nil || b.Address != "10.0.0.1:80" {
+				return false
+			}
+		}
+		return true
+	}
+	if !routed("/old/x") {
+		t.Fatal("/old is not routed before the reload")
+	}
+
+	writeFile(t, path, routes("/new"))
+	ReloadConfig(lb, path)
+	if !routed("/new/x") {
+		t.Fatal("/new is not routed after the reload")
+	}
+	if routed("/old/x") {
+		t.Fatal("/old is still routed after the reload")
+	}
+}
+
+// algorithmLabels returns the algorithms akash_algorithm_info reports.
+func algorithmLabels(t *testing.T) []string {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.AlgorithmInfo)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var algorithms []string
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				algorithms = append(algorithms, label.GetValue())
+			}
+		}
+	}
+	return algorithms
+}
+
+func TestReloadUpdatesAlgorithmInfo(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "akash.json")
+	writeConfig(t, path, "round_robin", 2)
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, nil)
+	ReloadConfig(lb, path)
+	if got := algorithmLabels(t); len(got) != 1 || got[0] != "round_robin" {
+		t.Fatalf("akash_algorithm_info reports %v, want [round_robin]", got)
+	}
+
+	writeConfig(t, path, "least_conn", 2)
+	ReloadConfig(lb, path)
+	if got := algorithmLabels(t); len(got) != 1 || got[0] != "least_conn" {
+		t.Fatalf("akash_algorithm_info after the reload reports %v, want [least_conn]", got)
+	}
+}
+
+// TestReloadRestartsWeightedRoundRobin changes a weight on reload after the
+// smooth weighted round robin state has built up and checks that the very
+// next picks follow the new weights exactly.
+func TestReloadRestartsWeightedRoundRobin(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "akash.json")
+	weights := func(a, b int) string {
+		return fmt.Sprintf(`{"listen": "0", "algorithm": "w_round_robin", "log_level": "error", "Backends": [{"address": "10.0.0.1:80", "weight": %d}, {"address": "10.0.0.2:80", "weight": %d}]}`, a, b)
+	}
+	writeFile(t, path, weights(1, 5))
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, nil)
+	ReloadConfig(lb, path)
+	for i := 0; i < 3; i++ {
+		_, _, release := lb.GetNextBackend("10.1.0.1:1", "/")
+		release()
+	}
+
+	writeFile(t, path, weights(3, 1))
+	ReloadConfig(lb, path)
+	for window := 0; window < 3; window++ {
+		counts := map[string]int{}
+		for i := 0; i < 4; i++ {
+			b, _, release := lb.GetNextBackend("10.1.0.1:1", "/")
+			release()
+			counts[b.Address]++
+		}
+		if counts["10.0.0.1:80"] != 3 || counts["10.0.0.2:80"] != 1 {
+			t.Fatalf("picks %d-%d after the reload were %v, want 3:1", window*4, window*4+3, counts)
+		}
+	}
+}
+
+// TestReloadChangesLogLevel turns debug logging on with a reload and off
+// again with the next one.
+func TestReloadChangesLogLevel(t *testing.T) {
+	var out syncBuffer
+	log.SetOutput(&out)
+	t.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+		logging.Configure("info", "text")
+	})
+
+	path := filepath.Join(t.TempDir(), "akash.json")
+	withLevel := func(level string) {
+		writeFile(t, path, fmt.Sprintf(`{"listen": "0", "log_level": %q, "Backends": [{"address": "10.0.0.1:80"}]}`, level))
+	}
+	withLevel("info")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, nil)
+	ReloadConfig(lb, path)
+
+	debugLogged := func(msg string) bool {
+		logging.Debugf("%s", msg)
+		return strings.Contains(out.String(), msg)
+	}
+	if debugLogged("debug before reload") {
+		t.Fatal("debug line logged at level info")
+	}
+
+	withLevel("debug")
+	ReloadConfig(lb, path)
+	if !debugLogged("debug after reload") {
+		t.Fatal("debug line missing after reloading with log_level debug")
+	}
+
+	withLevel("info")
+	ReloadConfig(lb, path)
+	if debugLogged("debug after reverting") {
+		t.Fatal("debug line still logged after reloading back to info")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for the logger and the test to share.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
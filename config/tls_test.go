@@ -0,0 +1,78 @@
+package config
+
+import (
+	"Akash/core"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func selfSignedCert(t *testing.T) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "allowed.example"},
+		DNSNames:     []string{"allowed.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestAllowedSNI terminates TLS for an allowed server name and checks the
+// handshake for any other name fails.
+func TestAllowedSNI(t *testing.T) {
+	CurrentTLSCert.Store(selfSignedCert(t))
+	lb := &core.LoadBalancer{}
+	lb.SetPool(&core.UserConfig{Algorithm: "round_robin", AllowedSNI: []string{"allowed.example"}}, nil)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: GetCertificate(lb)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	handshake := func(serverName string) error {
+		conn, err := net.DialTimeout("tcp", ln.Addr().String(), 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	}
+
+	if err := handshake("Allowed.Example"); err != nil {
+		t.Fatalf("handshake for an allowed name failed: %v", err)
+	}
+	if err := handshake("other.example"); err == nil {
+		t.Fatal("handshake for a name outside allowed_sni succeeded")
+	}
+}
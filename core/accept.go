@@ -0,0 +1,25 @@
+package core
+
+import (
+	"Akash/logging"
+	"net"
+	"time"
+)
+
+// nilAcceptBackoff is how long Accept pauses after the listener returned
+// neither a connection nor an error.
+const nilAcceptBackoff = 50 * time.Millisecond
+
+// Accept waits for the next connection on ln. Custom listeners may hand
+// back a nil conn without an error; Accept then logs it, rate limited, and
+// tries again after a short pause instead of spinning on the listener.
+func Accept(ln net.Listener) (net.Conn, error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil || conn != nil {
+			return conn, err
+		}
+		logging.Limited.Warnf("Accept returned no connection and no error, retrying")
+		time.Sleep(nilAcceptBackoff)
+	}
+}
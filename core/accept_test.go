@@ -0,0 +1,53 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeListener hands out the queued results of Accept in order and counts
+// the calls.
+type fakeListener struct {
+	net.Listener
+	results []fakeAccept
+	calls   int
+}
+
+type fakeAccept struct {
+	conn net.Conn
+	err  error
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	r := l.results[l.calls]
+	l.calls++
+	return r.conn, r.err
+}
+
+func TestAcceptSkipsNilConnsWithBackoff(t *testing.T) {
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	ln := &fakeListener{results: []fakeAccept{{}, {}, {}, {conn: conn}}}
+
+	start := time.Now()
+	got, err := Accept(ln)
+	if err != nil || got != conn {
+		t.Fatalf("Accept = %v, %v, want the listener's connection", got, err)
+	}
+	if ln.calls != 4 {
+		t.Fatalf("listener called %d times, want 4", ln.calls)
+	}
+	if elapsed := time.Since(start); elapsed < 3*nilAcceptBackoff {
+		t.Fatalf("three empty accepts took %s, want at least %s of backoff", elapsed, 3*nilAcceptBackoff)
+	}
+}
+
+func TestAcceptReturnsErrors(t *testing.T) {
+	wantErr := errors.New("accept failed")
+	ln := &fakeListener{results: []fakeAccept{{}, {err: wantErr}}}
+	if _, err := Accept(ln); err != wantErr {
+		t.Fatalf("Accept error %v, want %v", err, wantErr)
+	}
+}
@@ -0,0 +1,104 @@
+package core
+
+import (
+	"Akash/logging"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultAlertDebounce = 30 * time.Second
+	alertPostTimeout     = 5 * time.Second
+)
+
+// Alert is the JSON body POSTed to alert_webhook_url.
+type Alert struct {
+	Event     string    `json:"event"`
+	Healthy   int       `json:"healthy"`
+	Total     int       `json:"total"`
+	Threshold int       `json:"threshold"`
+	Time      time.Time `json:"time"`
+}
+
+const (
+	AlertBackendsUnhealthy = "backends_unhealthy"
+	AlertBackendsRecovered = "backends_recovered"
+)
+
+// healthAlerter tracks whether the healthy backend count is below the alert
+// threshold and notifies the webhook once the state has held for the
+// debounce period, so a single flapping probe doesn't page anyone.
+type healthAlerter struct {
+	alerting     bool
+	pendingSince time.Time
+	client       *http.Client
+}
+
+func newHealthAlerter() *healthAlerter {
+	return &healthAlerter{client: &http.Client{Timeout: alertPostTimeout}}
+}
+
+func (a *healthAlerter) observe(cfg *UserConfig, healthy, total int, now time.Time) {
+	if cfg.AlertWebhookURL == "" {
+		return
+	}
+
+	threshold := cfg.AlertMinHealthy
+	if threshold <= 0 {
+		threshold = 1
+	}
+	debounce := cfg.AlertDebounce.Duration()
+	if debounce <= 0 {
+		debounce = defaultAlertDebounce
+	}
+
+	below := healthy < threshold
+	if below == a.alerting {
+		a.pendingSince = time.Time{}
+		return
+	}
+	if a.pendingSince.IsZero() {
+		a.pendingSince = now
+	}
+	if now.Sub(a.pendingSince) < debounce {
+		return
+	}
+
+	a.alerting = below
+	a.pendingSince = time.Time{}
+
+	alert := Alert{
+		Event:     AlertBackendsRecovered,
+		Healthy:   healthy,
+		Total:     total,
+		Threshold: threshold,
+		Time:      now,
+	}
+	if below {
+		alert.Event = AlertBackendsUnhealthy
+	}
+	go a.send(cfg.AlertWebhookURL, alert)
+}
+
+func (a *healthAlerter) send(url string, alert Alert) {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		logging.Errorf("Failed to encode alert: %v", err)
+		return
+	}
+
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logging.Errorf("Failed to send %s alert: %v", alert.Event, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		logging.Warnf("Alert webhook returned %s for %s alert", resp.Status, alert.Event)
+		return
+	}
+	logging.Infof("Sent %s alert: %d/%d backends healthy", alert.Event, alert.Healthy, alert.Total)
+}
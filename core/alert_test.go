@@ -0,0 +1,68 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestHealthAlertFiresAndRecovers drives the alerter across the threshold
+// with a fake webhook and checks one debounced alert each way.
+func TestHealthAlertFiresAndRecovers(t *testing.T) {
+	alerts := make(chan Alert, 10)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("webhook got an undecodable alert: %v", err)
+		}
+		alerts <- alert
+	}))
+	defer webhook.Close()
+
+	cfg := &UserConfig{
+		AlertWebhookURL: webhook.URL,
+		AlertMinHealthy: 2,
+		AlertDebounce:   Duration(10 * time.Second),
+	}
+	a := newHealthAlerter()
+	start := time.Now()
+	at := func(d time.Duration) time.Time { return start.Add(d) }
+
+	expect := func(event string, healthy int) {
+		t.Helper()
+		select {
+		case alert := <-alerts:
+			if alert.Event != event || alert.Healthy != healthy || alert.Total != 4 || alert.Threshold != 2 {
+				t.Fatalf("got alert %+v, want %s with %d/4 healthy", alert, event, healthy)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s alert", event)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case alert := <-alerts:
+			t.Fatalf("unexpected alert %+v", alert)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	a.observe(cfg, 4, 4, at(0))
+	// a dip shorter than the debounce is not reported
+	a.observe(cfg, 1, 4, at(time.Second))
+	a.observe(cfg, 3, 4, at(5*time.Second))
+	a.observe(cfg, 1, 4, at(6*time.Second))
+	expectNone()
+
+	a.observe(cfg, 1, 4, at(16*time.Second))
+	expect(AlertBackendsUnhealthy, 1)
+	a.observe(cfg, 0, 4, at(30*time.Second))
+	expectNone()
+
+	a.observe(cfg, 2, 4, at(31*time.Second))
+	a.observe(cfg, 2, 4, at(41*time.Second))
+	expect(AlertBackendsRecovered, 2)
+}
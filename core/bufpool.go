@@ -0,0 +1,35 @@
+package core
+
+import "sync"
+
+// bufferTiers are the buffer sizes handed out by TieredPool, smallest first.
+var bufferTiers = []int{4 << 10, 32 << 10, 256 << 10}
+
+// growAfterFullReads is how many consecutive reads must fill a buffer
+// before the pipe moves up to the next tier.
+const growAfterFullReads = 4
+
+// TieredPool hands out copy buffers in several sizes. Every pipe starts on
+// the smallest tier, so connections that only exchange small messages stay
+// cheap, and moves up once it keeps filling its buffer, so bulk transfers
+// need fewer syscalls.
+type TieredPool struct {
+	pools []sync.Pool
+}
+
+func NewTieredPool() *TieredPool {
+	p := &TieredPool{pools: make([]sync.Pool, len(bufferTiers))}
+	for i, size := range bufferTiers {
+		size := size
+		p.pools[i].New = func() interface{} { return make([]byte, size) }
+	}
+	return p
+}
+
+func (p *TieredPool) get(tier int) []byte {
+	return p.pools[tier].Get().([]byte)
+}
+
+func (p *TieredPool) put(tier int, buf []byte) {
+	p.pools[tier].Put(buf)
+}
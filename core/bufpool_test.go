@@ -0,0 +1,91 @@
+package core
+
+import (
+	"io"
+	"sync"
+	"testing"
+)
+
+// workload is one proxied connection: rounds request/response exchanges,
+// after which the client closes. Each side has its own message buffers, set
+// up once so they don't count towards the proxy's memory.
+type workload struct {
+	name                    string
+	rounds                  int
+	clientReq, clientResp   []byte
+	backendReq, backendResp []byte
+}
+
+func newWorkload(name string, rounds, request, response int) *workload {
+	return &workload{
+		name:        name,
+		rounds:      rounds,
+		clientReq:   make([]byte, request),
+		clientResp:  make([]byte, response),
+		backendReq:  make([]byte, request),
+		backendResp: make([]byte, response),
+	}
+}
+
+func (w *workload) run(b *testing.B, opts ProxyOptions) {
+	clientSide, client := tcpPair(b)
+	backendSide, backend := tcpPair(b)
+	proxied := make(chan CloseReason, 1)
+	go func() { proxied <- Proxy(clientSide, backendSide, opts) }()
+
+	go func() {
+		for {
+			if _, err := io.ReadFull(backend, w.backendReq); err != nil {
+				backend.Close()
+				return
+			}
+			if _, err := backend.Write(w.backendResp); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < w.rounds; i++ {
+		if _, err := client.Write(w.clientReq); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(client, w.clientResp); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client.Close()
+	<-proxied
+}
+
+// BenchmarkBufferPool compares the tiered pool with the single 32KB pool on
+// chatty connections of small messages and on bulk transfers. Each
+// connection gets a fresh pool, so B/op is the buffer memory the connection
+// needed and MB/s the proxied throughput.
+func BenchmarkBufferPool(b *testing.B) {
+	workloads := []*workload{
+		newWorkload("small", 50, 64, 256),
+		newWorkload("bulk", 1, 64, 8<<20),
+	}
+	pools := []struct {
+		name string
+		opts func() ProxyOptions
+	}{
+		{"single", func() ProxyOptions {
+			return ProxyOptions{BufPool: &sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}}
+		}},
+		{"tiered", func() ProxyOptions {
+			return ProxyOptions{Buffers: NewTieredPool()}
+		}},
+	}
+	for _, w := range workloads {
+		for _, p := range pools {
+			b.Run(w.name+"/"+p.name, func(b *testing.B) {
+				b.ReportAllocs()
+				b.SetBytes(int64(w.rounds * (len(w.clientReq) + len(w.clientResp))))
+				for i := 0; i < b.N; i++ {
+					w.run(b, p.opts())
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// capacityRecheck bounds how long WaitForCapacity sleeps without a signal,
+// so health changes that free capacity are noticed too.
+const capacityRecheck = time.Second
+
+// connLimit returns the most connections b may have open, or 0 for no
+// limit. The backend's own max_conns wins; otherwise max_conns_per_weight
+// scales with its weight, counting a weight below 1 as 1. Must be called
+// with b.mutex held.
+func (b *Backend) connLimit() int {
+	if b.MaxConns > 0 {
+		return b.MaxConns
+	}
+	return b.maxConnsPerWeight * max(b.Weight, 1)
+}
+
+// hasCapacity must be called with b.mutex held.
+func (b *Backend) hasCapacity() bool {
+	limit := b.connLimit()
+	return limit <= 0 || b.ActiveConnections < int32(limit)
+}
+
+func (b *Backend) setMaxConnsPerWeight(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.maxConnsPerWeight = n
+}
+
+// Admit reserves a connection slot for a client that has been accepted but
+// not yet given a backend, e.g. while its TLS handshake runs, so Saturated
+// counts it. The returned function gives the slot back and must be called
+// once the client has a backend or has been turned away; the slot is held
+// until then even if the backend was already picked.
+func (lb *LoadBalancer) Admit() (done func()) {
+	lb.admitting.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lb.admitting.Add(-1)
+			lb.notifyCapacity()
+		})
+	}
+}
+
+// Saturated reports whether the backends that could take traffic have no
+// max_conns room left beyond the clients still being admitted. A pool with
+// no healthy backends is not saturated; new connections to it are rejected
+// rather than held back.
+func (lb *LoadBalancer) Saturated() bool {
+	candidates, free := 0, 0
+	pool := lb.Pool()
+	for _, b := range pool.Backends {
+		b.mutex.Lock()
+		up := b.IsHealthy && !b.Draining && !pool.weightedOut(b)
+		limit := b.connLimit()
+		room := limit - int(b.ActiveConnections)
+		b.mutex.Unlock()
+
+		if !up {
+			continue
+		}
+		if limit <= 0 {
+			return false
+		}
+		candidates++
+		free += max(room, 0)
+	}
+	return candidates > 0 && free <= int(lb.admitting.Load())
+}
+
+// WaitForCapacity blocks while the pool is saturated, waking when a
+// connection is released. It returns false if ctx is cancelled first.
+func (lb *LoadBalancer) WaitForCapacity(ctx context.Context) bool {
+	signal := lb.capacitySignal()
+	for lb.Saturated() {
+		timer := time.NewTimer(capacityRecheck)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-signal:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	return true
+}
+
+// notifyCapacity wakes a goroutine blocked in WaitForCapacity, if any.
+func (lb *LoadBalancer) notifyCapacity() {
+	select {
+	case lb.capacitySignal() <- struct{}{}:
+	default:
+	}
+}
+
+func (lb *LoadBalancer) capacitySignal() chan struct{} {
+	lb.capacityOnce.Do(func() {
+		lb.capacityFreed = make(chan struct{}, 1)
+	})
+	return lb.capacityFreed
+}
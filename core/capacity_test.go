@@ -0,0 +1,163 @@
+package core
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitsForCapacity reports whether WaitForCapacity is still blocked after a
+// short while, and returns a channel closed once it has returned.
+func waitsForCapacity(t *testing.T, lb *LoadBalancer) (blocked bool, returned <-chan struct{}) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		lb.WaitForCapacity(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+		return false, done
+	case <-time.After(50 * time.Millisecond):
+		return true, done
+	}
+}
+
+// TestAcceptPausesUntilCapacity saturates every backend and checks that
+// the backpressure wait holds accepting back until a connection ends.
+func TestAcceptPausesUntilCapacity(t *testing.T) {
+	lb := &LoadBalancer{}
+	backends := []*Backend{
+		NewBackend(&Backend{Address: "a:1", MaxConns: 1}),
+		NewBackend(&Backend{Address: "b:1", MaxConns: 1}),
+	}
+	lb.SetPool(&UserConfig{Algorithm: "round_robin"}, backends)
+
+	if lb.Saturated() {
+		t.Fatal("empty pool is saturated")
+	}
+	_, _, releaseFirst := lb.GetNextBackend("10.0.0.1:1", "/")
+	if blocked, _ := waitsForCapacity(t, lb); blocked {
+		t.Fatal("WaitForCapacity blocked with a backend still free")
+	}
+	_, _, releaseSecond := lb.GetNextBackend("10.0.0.2:1", "/")
+	defer releaseSecond()
+	if !lb.Saturated() {
+		t.Fatal("pool with every backend at max_conns is not saturated")
+	}
+	blocked, returned := waitsForCapacity(t, lb)
+	if !blocked {
+		t.Fatal("WaitForCapacity returned while saturated")
+	}
+
+	releaseFirst()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("WaitForCapacity still blocked after a connection was released")
+	}
+
+	// cancelling the wait, as shutdown does, unblocks it too
+	_, _, releaseFirst = lb.GetNextBackend("10.0.0.1:1", "/")
+	defer releaseFirst()
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan bool, 1)
+	go func() { waited <- lb.WaitForCapacity(ctx) }()
+	cancel()
+	select {
+	case ok := <-waited:
+		if ok {
+			t.Fatal("WaitForCapacity reported capacity after being cancelled")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("WaitForCapacity ignored cancellation")
+	}
+}
+
+// TestAdmissionsCountTowardsSaturation checks that clients accepted but not
+// yet routed, e.g. mid-handshake, hold a slot until they have a backend or
+// are turned away.
+func TestAdmissionsCountTowardsSaturation(t *testing.T) {
+	lb := &LoadBalancer{}
+	backends := []*Backend{
+		NewBackend(&Backend{Address: "a:1", MaxConns: 1}),
+		NewBackend(&Backend{Address: "b:1", MaxConns: 1}),
+	}
+	lb.SetPool(&UserConfig{Algorithm: "round_robin"}, backends)
+
+	// two admitted clients use up the pool before either has a backend
+	first, second := lb.Admit(), lb.Admit()
+	if !lb.Saturated() {
+		t.Fatal("pool with every slot reserved by admissions is not saturated")
+	}
+	blocked, returned := waitsForCapacity(t, lb)
+	if !blocked {
+		t.Fatal("WaitForCapacity returned while saturated")
+	}
+
+	// a client that is turned away gives its slot back
+	second()
+	second()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("WaitForCapacity still blocked after a reservation was returned")
+	}
+
+	// a routed client keeps its slot through the backend instead
+	_, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+	defer release()
+	first()
+	if lb.Saturated() {
+		t.Fatal("pool saturated with one backend still free")
+	}
+}
+
+func TestSaturatedIgnoresUnlimitedAndDownBackends(t *testing.T) {
+	lb := &LoadBalancer{}
+	limited := NewBackend(&Backend{Address: "a:1", MaxConns: 1})
+	unlimited := NewBackend(&Backend{Address: "b:1"})
+	lb.SetPool(&UserConfig{Algorithm: "round_robin"}, []*Backend{limited, unlimited})
+
+	done := lb.Admit()
+	defer done()
+	if lb.Saturated() {
+		t.Fatal("pool with an unlimited backend is saturated")
+	}
+
+	setBackendHealth(unlimited, false)
+	if !lb.Saturated() {
+		t.Fatal("pool whose only up backend is reserved is not saturated")
+	}
+
+	setBackendHealth(limited, false)
+	if lb.Saturated() {
+		t.Fatal("pool with no healthy backends is saturated")
+	}
+}
+
+// TestMaxConnsPerWeight fills a pool of a weight-1 and a weight-3 backend
+// and checks the heavier one takes three times the connections before
+// selection spills over and then runs out.
+func TestMaxConnsPerWeight(t *testing.T) {
+	lb := &LoadBalancer{}
+	light := NewBackend(&Backend{Address: "light:1", Weight: 1})
+	heavy := NewBackend(&Backend{Address: "heavy:1", Weight: 3})
+	lb.SetPool(&UserConfig{Algorithm: "least_conn", MaxConnsPerWeight: 4}, []*Backend{light, heavy})
+
+	counts := map[*Backend]int{}
+	for i := 0; i < 20; i++ {
+		b, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+		if b == nil {
+			break
+		}
+		defer release()
+		counts[b]++
+	}
+	if counts[light] != 4 || counts[heavy] != 12 {
+		t.Fatalf("light took %d and heavy %d connections, want 4 and 12", counts[light], counts[heavy])
+	}
+	if !lb.Saturated() {
+		t.Fatal("pool not saturated with every backend at its limit")
+	}
+}
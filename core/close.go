@@ -0,0 +1,56 @@
+package core
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// GracefulClose closes conn so the peer sees a clean FIN rather than an RST.
+// It shuts down the write side, discards whatever the peer still sends for up
+// to drainTimeout (or until the peer closes its side), then closes. Closing
+// a socket with unread data is what makes the kernel send an RST, which
+// truncates whatever the peer had not yet read. Connections that can't
+// half-close, or a non-positive drainTimeout, are closed immediately.
+//
+// Nothing else may be reading from conn or setting its deadlines while it
+// drains; Proxy stops its pipes before closing a client this way.
+func GracefulClose(conn net.Conn, drainTimeout time.Duration) {
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok || drainTimeout <= 0 {
+		conn.Close()
+		return
+	}
+
+	if err := cw.CloseWrite(); err != nil {
+		conn.Close()
+		return
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+		conn.Close()
+		return
+	}
+	io.Copy(io.Discard, conn)
+	conn.Close()
+}
+
+// WaitDrained waits until every connection counted in wg has finished or
+// timeout has passed, whichever comes first, and reports whether the
+// connections finished on their own.
+func WaitDrained(wg *sync.WaitGroup, timeout time.Duration) bool {
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
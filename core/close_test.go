@@ -0,0 +1,162 @@
+package core
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (local, remote net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	remote, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local = <-accepted
+	if local == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return local, remote
+}
+
+// TestProxyCutClosesClientWithoutReset cuts proxied connections while the
+// client keeps sending and is behind on reading a large response. The
+// client must get everything Akash forwarded followed by a FIN; with an
+// RST, Akash's kernel drops what it had not sent yet.
+func TestProxyCutClosesClientWithoutReset(t *testing.T) {
+	tests := []struct {
+		name string
+		opts func(stop chan struct{}) ProxyOptions
+		cut  func(stop chan struct{})
+	}{
+		{
+			name: "stop",
+			opts: func(stop chan struct{}) ProxyOptions { return ProxyOptions{Stop: stop} },
+			cut:  func(stop chan struct{}) { close(stop) },
+		},
+		{
+			name: "stop with idle timeout",
+			opts: func(stop chan struct{}) ProxyOptions { return ProxyOptions{Stop: stop, IdleTimeout: time.Minute} },
+			cut:  func(stop chan struct{}) { close(stop) },
+		},
+		{
+			name: "max lifetime",
+			opts: func(chan struct{}) ProxyOptions { return ProxyOptions{MaxLifetime: 100 * time.Millisecond} },
+			cut:  func(chan struct{}) {},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSide, client := tcpPair(t)
+			// small buffers keep part of the response queued in Akash's
+			// kernel when it closes
+			client.(*net.TCPConn).SetReadBuffer(16 << 10)
+			clientSide.(*net.TCPConn).SetWriteBuffer(16 << 10)
+			backendSide, backend := tcpPair(t)
+			go io.Copy(io.Discard, backend)
+			go backend.Write(make([]byte, 8<<20))
+
+			stop := make(chan struct{})
+			opts := tt.opts(stop)
+			opts.BufPool = &sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}
+			opts.CloseTimeout = 2 * time.Second
+			var stats ProxyStats
+			opts.Stats = &stats
+			proxied := make(chan CloseReason, 1)
+			go func() { proxied <- Proxy(clientSide, backendSide, opts) }()
+
+			// keep data in flight towards Akash until the client sees
+			// the close, so closing on unread data would send an RST
+			sawClose := make(chan struct{})
+			go func() {
+				chunk := make([]byte, 1024)
+				for {
+					select {
+					case <-sawClose:
+						client.(*net.TCPConn).CloseWrite()
+						return
+					default:
+					}
+					if _, err := client.Write(chunk); err != nil {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+
+			time.Sleep(50 * time.Millisecond)
+			tt.cut(stop)
+			// the client only catches up after Akash has started closing
+			time.Sleep(200 * time.Millisecond)
+
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := io.Copy(io.Discard, client)
+			close(sawClose)
+			if err != nil {
+				t.Fatalf("client read ended with %v after %d bytes, want a clean EOF", err, n)
+			}
+
+			select {
+			case <-proxied:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Proxy did not return after the connection was cut")
+			}
+			if forwarded := stats.FromBackend.Load(); n != forwarded {
+				t.Fatalf("client read %d bytes, Akash forwarded %d", n, forwarded)
+			}
+
+			// the drain ends once the client closes its side; the
+			// socket must then be gone without a reset
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := client.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+				t.Fatalf("client saw %v after the close, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestWaitDrained(t *testing.T) {
+	const timeout = 2 * time.Second
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		time.AfterFunc(time.Duration(i)*20*time.Millisecond, wg.Done)
+	}
+	start := time.Now()
+	if !WaitDrained(&wg, timeout) {
+		t.Fatal("WaitDrained hit the deadline although every connection finished")
+	}
+	if elapsed := time.Since(start); elapsed >= timeout/2 {
+		t.Fatalf("WaitDrained returned after %s, want soon after the last connection ended", elapsed)
+	}
+
+	var stuck sync.WaitGroup
+	stuck.Add(1)
+	defer stuck.Done()
+	start = time.Now()
+	if WaitDrained(&stuck, 100*time.Millisecond) {
+		t.Fatal("WaitDrained reported a drain with a connection still open")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("WaitDrained gave up after %s, before the deadline", elapsed)
+	}
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"Akash/logging"
+	"Akash/metrics"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnTracker keeps count of the client connections Akash has admitted so
+// shutdown can wait for them and cut the ones that are left. Admitting a
+// connection is ordered against the start of shutdown: a connection is
+// either tracked before Shutdown returns, and then seen by CloseAll and
+// waited for, or it is rejected.
+type ConnTracker struct {
+	mu           sync.Mutex
+	shuttingDown atomic.Bool
+	closing      atomic.Bool
+	stop         chan struct{}
+	wg           sync.WaitGroup
+	// pending holds the admitted clients that are not being proxied yet
+	pending map[net.Conn]struct{}
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		stop:    make(chan struct{}),
+		pending: make(map[net.Conn]struct{}),
+	}
+}
+
+// Admit starts tracking conn and counts it in akash_active_connections. It
+// returns false, tracking nothing, once shutdown has started; the caller
+// then rejects conn.
+func (t *ConnTracker) Admit(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.shuttingDown.Load() {
+		return false
+	}
+	t.wg.Add(1)
+	t.pending[conn] = struct{}{}
+	metrics.ActiveConns.Inc()
+	return true
+}
+
+// Proxying records that conn has been handed to Proxy. From then on
+// CloseAll reaches it through Stop, so Proxy can close it cleanly, rather
+// than closing it outright.
+func (t *ConnTracker) Proxying(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.pending, conn)
+	t.mu.Unlock()
+}
+
+// Done stops tracking an admitted conn. It must be called exactly once for
+// every connection Admit accepted.
+func (t *ConnTracker) Done(conn net.Conn) {
+	t.mu.Lock()
+	delete(t.pending, conn)
+	t.mu.Unlock()
+	metrics.ActiveConns.Dec()
+	t.wg.Done()
+}
+
+// Shutdown stops admitting connections.
+func (t *ConnTracker) Shutdown() {
+	t.mu.Lock()
+	t.shuttingDown.Store(true)
+	t.mu.Unlock()
+}
+
+// ShuttingDown reports whether Shutdown has been called.
+func (t *ConnTracker) ShuttingDown() bool {
+	return t.shuttingDown.Load()
+}
+
+// CloseAll cuts every tracked connection: proxied ones through Stop, and
+// the rest, still in their TLS handshake or waiting for a backend, by
+// closing them since they have nothing to drain. It must be called once,
+// after Shutdown.
+func (t *ConnTracker) CloseAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closing.Store(true)
+	close(t.stop)
+	for conn := range t.pending {
+		logging.Infof("Closing active connection: %v", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// Closing reports whether CloseAll has started cutting connections, so a
+// connection that ends afterwards was closed by shutdown.
+func (t *ConnTracker) Closing() bool {
+	return t.closing.Load()
+}
+
+// Stop is closed by CloseAll; it is meant as ProxyOptions.Stop.
+func (t *ConnTracker) Stop() <-chan struct{} {
+	return t.stop
+}
+
+// Wait blocks until every admitted connection is done.
+func (t *ConnTracker) Wait() {
+	t.wg.Wait()
+}
+
+// WaitDrained is like Wait but gives up after timeout, and reports whether
+// the connections finished on their own.
+func (t *ConnTracker) WaitDrained(timeout time.Duration) bool {
+	return WaitDrained(&t.wg, timeout)
+}
@@ -0,0 +1,90 @@
+package core
+
+import (
+	"Akash/metrics"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func activeConnsGauge(t *testing.T) float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.ActiveConns)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return families[0].GetMetric()[0].GetGauge().GetValue()
+}
+
+// TestAdmitRacesShutdown admits connections from many goroutines while
+// shutdown starts and checks every connection is either fully tracked or
+// rejected: shutdown's wait returns, nothing is left pending and
+// akash_active_connections is back where it started.
+func TestAdmitRacesShutdown(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		before := activeConnsGauge(t)
+		tracker := NewConnTracker()
+
+		var accepted sync.WaitGroup
+		var mu sync.Mutex
+		admitted, rejected := 0, 0
+		for i := 0; i < 50; i++ {
+			accepted.Add(1)
+			go func(i int) {
+				defer accepted.Done()
+				client, server := net.Pipe()
+				defer client.Close()
+				if !tracker.Admit(server) {
+					server.Close()
+					mu.Lock()
+					rejected++
+					mu.Unlock()
+					return
+				}
+				mu.Lock()
+				admitted++
+				mu.Unlock()
+				// half the connections get to the proxy phase, the rest
+				// are still pending when shutdown cuts them
+				if i%2 == 0 {
+					tracker.Proxying(server)
+					go func() {
+						<-tracker.Stop()
+						server.Close()
+						tracker.Done(server)
+					}()
+					return
+				}
+				go func() {
+					server.Read(make([]byte, 1))
+					tracker.Done(server)
+				}()
+			}(i)
+		}
+
+		tracker.Shutdown()
+		if tracker.Admit(&flakyConn{}) {
+			t.Fatal("connection admitted after Shutdown")
+		}
+		tracker.CloseAll()
+		accepted.Wait()
+
+		if !tracker.WaitDrained(5 * time.Second) {
+			t.Fatalf("round %d: shutdown still waiting for connections (%d admitted, %d rejected)", round, admitted, rejected)
+		}
+		if n := len(tracker.pending); n != 0 {
+			t.Fatalf("round %d: %d connections still pending", round, n)
+		}
+		if after := activeConnsGauge(t); after != before {
+			t.Fatalf("round %d: akash_active_connections went from %v to %v", round, before, after)
+		}
+		if admitted+rejected != 50 {
+			t.Fatalf("round %d: %d admitted and %d rejected out of 50", round, admitted, rejected)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package core
 
 import (
+	"Akash/logging"
+	"Akash/metrics"
 	"hash/fnv"
-	"log"
+	"math/rand"
 	"net"
 	"strings"
 	"sync"
@@ -10,31 +12,203 @@ import (
 	"time"
 )
 
+const (
+	defaultHealthCheckFreq     = 10 * time.Second
+	defaultHealthScoreUp       = 0.7
+	defaultHealthScoreDown     = 0.3
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
 type UserConfig struct {
-	Host            string    `json:"host"`
-	Port            string    `json:"listen"`
-	Backends        []Backend `json:"Backends"`
-	Algorithm       string    `json:"algorithm"`
-	MaxConnections  int       `json:"max_connections"`
-	TimeoutSeconds  int       `json:"timeout_seconds"`
-	HealthCheckPath string    `json:"health_check_path"`
-	HealthCheckPort string    `json:"health_check_port"`
-	HealthCheckFreq int       `json:"health_check_freq"`
-	TLSCertFile     string    `json:"tls_cert_file"`
-	TLSKeyFile      string    `json:"tls_key_file"`
+	Host                         string     `json:"host"`
+	Port                         string     `json:"listen"`
+	Backends                     []*Backend `json:"Backends"`
+	BackendsFile                 string     `json:"backends_file"`
+	AllowDuplicateBackends       bool       `json:"allow_duplicate_backends"`
+	Algorithm                    string     `json:"algorithm"`
+	MaxConnections               int        `json:"max_connections"`
+	Timeout                      Duration   `json:"timeout"`
+	HealthCheckPath              string     `json:"health_check_path"`
+	HealthCheckPort              string     `json:"health_check_port"`
+	HealthCheckInterval          Duration   `json:"health_check_interval"`
+	HealthCheckConcurrency       int        `json:"health_check_concurrency"`
+	HealthCheckPrioritizeFailing bool       `json:"health_check_prioritize_failing"`
+	HealthCheckDrainStatus       int        `json:"health_check_drain_status"`
+	HealthCheckDrainHeader       string     `json:"health_check_drain_header"`
+	DrainGracePeriod             Duration   `json:"drain_grace_period"`
+	HealthScoreAlpha             float64    `json:"health_score_alpha"`
+	HealthScoreUp                float64    `json:"health_score_up"`
+	HealthScoreDown              float64    `json:"health_score_down"`
+	TLSCertFile                  string     `json:"tls_cert_file"`
+	TLSKeyFile                   string     `json:"tls_key_file"`
+	AllowedSNI                   []string   `json:"allowed_sni"`
+	HedgeAfter                   Duration   `json:"hedge_after"`
+	Transparent                  bool       `json:"transparent"`
+	AlertWebhookURL              string     `json:"alert_webhook_url"`
+	AlertMinHealthy              int        `json:"alert_min_healthy"`
+	AlertDebounce                Duration   `json:"alert_debounce"`
+	SelectionHook                string     `json:"selection_hook"`
+	HTTP2RequestMetrics          bool       `json:"http2_request_metrics"`
+	ConnMaxLifetime              Duration   `json:"conn_max_lifetime"`
+	IdleTimeout                  Duration   `json:"idle_timeout"`
+	GracefulCloseTimeout         Duration   `json:"graceful_close_timeout"`
+	LogLevel                     string     `json:"log_level"`
+	LogFormat                    string     `json:"log_format"`
+	StatsLogInterval             Duration   `json:"stats_log_interval"`
+	BackpressureAccept           bool       `json:"backpressure_accept"`
+	MetricsExemplars             bool       `json:"metrics_exemplars"`
+	DefaultBackendPort           string     `json:"default_backend_port"`
+	DrainTimeout                 Duration   `json:"drain_timeout"`
+	BufferPool                   string     `json:"buffer_pool"`
+	WarmupConcurrency            int        `json:"warmup_concurrency"`
+	PprofAddr                    string     `json:"pprof_addr"`
+	MaxConnsPerWeight            int        `json:"max_conns_per_weight"`
+	SelectionStreakWarn          int        `json:"selection_streak_warn"`
+	HandshakeTimeout             Duration   `json:"tls_handshake_timeout"`
+	ReconnectOnBackendDrop       bool       `json:"reconnect_on_backend_drop"`
+	MaxRetries                   int        `json:"max_retries"`
+
+	// Deprecated: use Timeout.
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// Deprecated: use HealthCheckInterval.
+	HealthCheckFreq int `json:"health_check_freq"`
+}
+
+// DialTimeout returns the backend dial timeout, falling back to the legacy
+// timeout_seconds field when timeout is not set.
+func (c *UserConfig) DialTimeout() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout.Duration()
+	}
+	return time.Duration(c.TimeoutSeconds) * time.Second
+}
+
+// healthScoreThresholds returns the EWMA score a backend must rise above to
+// become healthy and fall below to become unhealthy.
+func (c *UserConfig) healthScoreThresholds() (up, down float64) {
+	up, down = c.HealthScoreUp, c.HealthScoreDown
+	if up <= 0 {
+		up = defaultHealthScoreUp
+	}
+	if down <= 0 {
+		down = defaultHealthScoreDown
+	}
+	return up, down
+}
+
+// TLSHandshakeTimeout returns how long a client may take to complete the
+// TLS handshake.
+func (c *UserConfig) TLSHandshakeTimeout() time.Duration {
+	if c.HandshakeTimeout > 0 {
+		return c.HandshakeTimeout.Duration()
+	}
+	return defaultTLSHandshakeTimeout
+}
+
+// AllowsSNI reports whether a TLS handshake for serverName may be terminated.
+// Every name is allowed when allowed_sni is empty.
+func (c *UserConfig) AllowsSNI(serverName string) bool {
+	if len(c.AllowedSNI) == 0 {
+		return true
+	}
+	for _, name := range c.AllowedSNI {
+		if strings.EqualFold(name, serverName) {
+			return true
+		}
+	}
+	return false
+}
+
+// HealthCheckFrequency returns the interval between health check cycles,
+// falling back to the legacy health_check_freq field and then to a default.
+func (c *UserConfig) HealthCheckFrequency() time.Duration {
+	if c.HealthCheckInterval > 0 {
+		return c.HealthCheckInterval.Duration()
+	}
+	if c.HealthCheckFreq > 0 {
+		return time.Duration(c.HealthCheckFreq) * time.Second
+	}
+	return defaultHealthCheckFreq
 }
 
 type Backend struct {
-	Address           string `json:"address"`
-	Weight            int    `json:"weight"`
-	IsHealthy         bool   `json:"-"`
-	ActiveConnections int32  `json:"-"`
+	Address           string    `json:"address"`
+	Weight            int       `json:"weight"`
+	IsHealthy         bool      `json:"-"`
+	Draining          bool      `json:"-"`
+	UnhealthySince    time.Time `json:"-"`
+	HealthScore       float64   `json:"-"`
+	ActiveConnections int32     `json:"-"`
 	mutex             sync.Mutex
 	LastChecked       time.Time `json:"-"`
 	CurrentWeight     int       `json:"-"`
 	Paths             []string  `json:"paths"`
+	MaxConns          int       `json:"max_conns"`
+	HealthCheckPath   string    `json:"health_check_path"`
+	TLS               bool      `json:"tls"`
+	Group             string    `json:"group"`
+	// maxConnsPerWeight is the pool-wide max_conns_per_weight
+	maxConnsPerWeight int
+	// served counts connections routed to the backend; fails counts its
+	// consecutive failed health checks. Both stay with the backend across
+	// reloads.
+	served atomic.Int32
+	fails  atomic.Int32
+}
+
+// BackendStatus is a point-in-time view of a backend that is safe to share
+// outside the balancer.
+type BackendStatus struct {
+	Address           string  `json:"address"`
+	Healthy           bool    `json:"healthy"`
+	Draining          bool    `json:"draining"`
+	HealthScore       float64 `json:"health_score"`
+	ActiveConnections int32   `json:"active_connections"`
+	Weight            int     `json:"weight"`
+	CurrentWeight     int     `json:"current_weight"`
+	Status            string  `json:"status"`
+	Reason            string  `json:"reason,omitempty"`
 }
 
+// Backend availability as reported in BackendStatus.
+const (
+	StatusAvailable   = "available"
+	StatusUnavailable = "unavailable"
+)
+
+// Reasons a backend is unavailable, or only partly available, for new
+// connections.
+const (
+	ReasonUnhealthy  = "unhealthy"
+	ReasonDrainGrace = "drain_grace"
+	ReasonDraining   = "draining"
+	ReasonWeightZero = "weight_zero"
+	ReasonSaturated  = "saturated"
+)
+
+// NewBackend returns a runtime backend for a configured one. Config backends
+// are never routed to directly, so their health state and lock stay unused.
+func NewBackend(cfg *Backend) *Backend {
+	return &Backend{
+		Address:         cfg.Address,
+		Weight:          cfg.Weight,
+		MaxConns:        cfg.MaxConns,
+		HealthCheckPath: cfg.HealthCheckPath,
+		TLS:             cfg.TLS,
+		Group:           cfg.Group,
+		Paths:           cfg.Paths,
+		IsHealthy:       true,
+		HealthScore:     1,
+	}
+}
+
+// Route labels for akash_route_matches_total. Path routes are labeled with
+// their configured prefix.
+const (
+	RouteDefault    = "default"
+	RouteHookPrefix = "hook:"
+)
+
 type Algorithm int
 
 const (
@@ -45,14 +219,60 @@ const (
 )
 
 type LoadBalancer struct {
-	Config          *UserConfig
-	Backends        []*Backend
-	Algo            Algorithm
 	ConnectionCount int32
 	Index           int32
-	BackendCounts   []int32
-	BackendFails    []int32
-	PathRoutes      map[string]*Backend
+
+	pool          atomic.Pointer[Pool]
+	capacityOnce  sync.Once
+	capacityFreed chan struct{}
+	admitting     atomic.Int32
+	streak        streakDetector
+}
+
+// Pool is the configuration and backend set a LoadBalancer routes with. A
+// reload publishes a new Pool rather than changing the current one, so
+// whoever loaded a Pool sees a consistent view of it; only the backends'
+// own state, guarded by their mutexes, changes underneath.
+type Pool struct {
+	Config   *UserConfig
+	Algo     Algorithm
+	Backends []*Backend
+	routes   map[string]*Backend
+}
+
+// Pool returns the pool currently used for new connections.
+func (lb *LoadBalancer) Pool() *Pool {
+	return lb.pool.Load()
+}
+
+// Config returns the configuration of the current pool.
+func (lb *LoadBalancer) Config() *UserConfig {
+	return lb.Pool().Config
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case RoundRobin:
+		return "round_robin"
+	case LeastConnections:
+		return "least_conn"
+	case IPHash:
+		return "ip_hash"
+	case WeightedRoundRobin:
+		return "w_round_robin"
+	default:
+		return "unknown"
+	}
+}
+
+// largeFleetSize is the pool size above which algorithms that scan every
+// backend per connection are worth a warning.
+const largeFleetSize = 1000
+
+// scansPool reports whether the algorithm looks at every backend for each
+// selection, which gets expensive for large fleets.
+func (a Algorithm) scansPool() bool {
+	return a == LeastConnections || a == WeightedRoundRobin
 }
 
 func ParseAlgorithm(name string) Algorithm {
@@ -66,163 +286,418 @@ func ParseAlgorithm(name string) Algorithm {
 	case "w_round_robin":
 		return WeightedRoundRobin
 	default:
-		log.Printf("Unknown algorithm %s, defaulting to round robin", name)
+		logging.Warnf("Unknown algorithm %s, defaulting to round robin", name)
 		return RoundRobin
 	}
 }
 
-func (lb *LoadBalancer) GetNextBackend(clientAddress, path string) (*Backend, int, func()) {
-	if len(lb.Backends) == 0 {
-		return nil, -1, func() {}
+// SetPool publishes cfg and backends, with the algorithm cfg names, as the
+// pool for new connections. Connections already routed keep their backend.
+func (lb *LoadBalancer) SetPool(cfg *UserConfig, backends []*Backend) {
+	algo := ParseAlgorithm(cfg.Algorithm)
+	for _, b := range backends {
+		b.setMaxConnsPerWeight(cfg.MaxConnsPerWeight)
 	}
-	var idx int
-	var backend *Backend
 
-	// path ? path based routing : lb algorithm based routing
-	for p, b := range lb.PathRoutes {
-		if strings.HasPrefix(path, p) {
-			b.mutex.Lock()
-			if !b.IsHealthy {
-				b.mutex.Unlock()
-				continue
-			}
-			b.ActiveConnections++
-			b.mutex.Unlock()
+	lb.pool.Store(&Pool{
+		Config:   cfg,
+		Algo:     algo,
+		Backends: backends,
+		routes:   buildPathRoutes(backends),
+	})
 
-			backend = b
+	if len(backends) >= largeFleetSize && algo.scansPool() {
+		logging.Warnf("%s scans all %d backends on every connection; consider round_robin or ip_hash for fleets this large", algo, len(backends))
+	}
+}
 
-			for i, backendCheck := range lb.Backends {
-				if backendCheck == backend {
-					idx = i
-					break
-				}
+// buildPathRoutes maps every configured path prefix to the backend serving it.
+func buildPathRoutes(backends []*Backend) map[string]*Backend {
+	routes := make(map[string]*Backend)
+	for _, b := range backends {
+		b.mutex.Lock()
+		paths := b.Paths
+		b.mutex.Unlock()
+		for _, p := range paths {
+			if existing, ok := routes[p]; ok && existing != b {
+				logging.Warnf("Path %s is configured for both %s and %s, using %s", p, existing.Address, b.Address, b.Address)
 			}
-			break
+			routes[p] = b
 		}
 	}
+	return routes
+}
 
-	switch lb.Algo {
-	case RoundRobin:
+// HealthyCount returns the number of healthy backends and the pool size.
+func (lb *LoadBalancer) HealthyCount() (healthy, total int) {
+	backends := lb.Pool().Backends
+	for _, b := range backends {
+		b.mutex.Lock()
+		if b.IsHealthy {
+			healthy++
+		}
+		b.mutex.Unlock()
+	}
+	return healthy, len(backends)
+}
 
-		for attempts := 0; attempts < len(lb.Backends); attempts++ {
-			idx := int(atomic.AddInt32(&lb.Index, 1)) % len(lb.Backends)
+// SetWeight changes the backend's weight. Smooth weighted round robin state
+// built up under the old weight would skew the new distribution, so
+// CurrentWeight restarts from zero when the weight changes.
+func (b *Backend) SetWeight(weight int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.Weight != weight {
+		b.Weight = weight
+		b.CurrentWeight = 0
+	}
+}
 
-			candidate := lb.Backends[idx]
+// SetMaxConns changes the backend's connection limit.
+func (b *Backend) SetMaxConns(maxConns int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.MaxConns = maxConns
+}
 
-			candidate.mutex.Lock()
-			healthy := candidate.IsHealthy
-			candidate.mutex.Unlock()
-			if healthy {
-				backend = candidate
-				break
-			}
-		}
+// SetHealthCheckPath changes the backend's own health check path.
+func (b *Backend) SetHealthCheckPath(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.HealthCheckPath = path
+}
 
-	case LeastConnections:
-		var minIdx int
-		var minConn int32
+// SetPaths changes the path prefixes routed to the backend. They take
+// effect with the next SetPool.
+func (b *Backend) SetPaths(paths []string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.Paths = paths
+}
 
-		lb.Backends[0].mutex.Lock()
-		minConn = lb.Backends[0].ActiveConnections
-		lb.Backends[0].mutex.Unlock()
+// Routable reports whether the backend may be given new connections. It
+// doesn't know the pool's algorithm, so a weight of 0 under w_round_robin
+// is left to the pool's own checks, such as RoutableCount.
+func (b *Backend) Routable() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.routable()
+}
 
-		for i := 1; i < len(lb.Backends); i++ {
-			lb.Backends[i].mutex.Lock()
-			currConn := lb.Backends[i].ActiveConnections
-			lb.Backends[i].mutex.Unlock()
+// routable must be called with b.mutex held. A draining backend, or one at
+// its max_conns limit, is healthy but takes no new connections.
+func (b *Backend) routable() bool {
+	return b.IsHealthy && !b.Draining && b.hasCapacity()
+}
 
-			if currConn < minConn {
-				minConn = currConn
-				minIdx = i
-			}
-		}
+// selectable reports whether b may be picked for a new connection. Beyond
+// routable backends, a backend that recently turned unhealthy is still
+// picked with a probability that falls linearly to zero over
+// drain_grace_period, so its traffic moves to the rest of the pool gradually.
+func (p *Pool) selectable(b *Backend) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return p.selectableLocked(b)
+}
 
-		backend = lb.Backends[minIdx]
+// weightedOut reports whether b's weight of 0 takes it out of rotation,
+// which it does under w_round_robin, path routes and hooks included. Must
+// be called with b.mutex held.
+func (p *Pool) weightedOut(b *Backend) bool {
+	return b.Weight <= 0 && p.Algo == WeightedRoundRobin
+}
 
-		backend.mutex.Lock()
-		backend.ActiveConnections++
-		backend.mutex.Unlock()
+// routable reports whether b takes new connections in this pool: it is
+// routable and not weighted out.
+func (p *Pool) routable(b *Backend) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.routable() && !p.weightedOut(b)
+}
 
-		idx = minIdx
+// selectableLocked must be called with b.mutex held.
+func (p *Pool) selectableLocked(b *Backend) bool {
+	if p.weightedOut(b) {
+		return false
+	}
+	if b.routable() {
+		return true
+	}
+	if !b.hasCapacity() {
+		return false
+	}
 
-	case IPHash:
-		host, _, err := net.SplitHostPort(clientAddress)
-		if err != nil {
-			host = clientAddress
+	grace := p.Config.DrainGracePeriod.Duration()
+	if grace <= 0 || b.IsHealthy || b.UnhealthySince.IsZero() {
+		return false
+	}
+	elapsed := time.Since(b.UnhealthySince)
+	if elapsed >= grace {
+		return false
+	}
+	share := 1 - float64(elapsed)/float64(grace)
+	return rand.Float64() < share
+}
+
+// availabilityLocked explains whether b can take new connections, in the
+// same order selection checks it. A backend still inside
+// drain_grace_period is reported available with reason drain_grace since
+// it keeps a share of new connections. Must be called with b.mutex held.
+func (p *Pool) availabilityLocked(b *Backend) (status, reason string) {
+	switch {
+	case p.weightedOut(b):
+		return StatusUnavailable, ReasonWeightZero
+	case !b.IsHealthy:
+		grace := p.Config.DrainGracePeriod.Duration()
+		if grace > 0 && !b.UnhealthySince.IsZero() && time.Since(b.UnhealthySince) < grace && b.hasCapacity() {
+			return StatusAvailable, ReasonDrainGrace
 		}
-		h := fnv.New32a()
-		h.Write([]byte(host))
-		hashVal := h.Sum32()
+		return StatusUnavailable, ReasonUnhealthy
+	case b.Draining:
+		return StatusUnavailable, ReasonDraining
+	case !b.hasCapacity():
+		return StatusUnavailable, ReasonSaturated
+	}
+	return StatusAvailable, ""
+}
 
-		idx = int(hashVal) % len(lb.Backends)
-		backend = lb.Backends[idx]
+// RoutableCount returns the number of backends that can accept new
+// connections and the pool size.
+func (lb *LoadBalancer) RoutableCount() (routable, total int) {
+	pool := lb.Pool()
+	backends := pool.Backends
+	for _, b := range backends {
+		if pool.routable(b) {
+			routable++
+		}
+	}
+	return routable, len(backends)
+}
 
-	case WeightedRoundRobin:
-		var total int
-		var selected *Backend
-		var selectedIdx int
+// Snapshot returns the current status of every backend in the pool.
+func (lb *LoadBalancer) Snapshot() []BackendStatus {
+	pool := lb.Pool()
+	backends := pool.Backends
+	statuses := make([]BackendStatus, 0, len(backends))
+	for _, b := range backends {
+		b.mutex.Lock()
+		statuses = append(statuses, BackendStatus{
+			Address:           b.Address,
+			Healthy:           b.IsHealthy,
+			Draining:          b.Draining,
+			HealthScore:       b.HealthScore,
+			ActiveConnections: b.ActiveConnections,
+			Weight:            b.Weight,
+			CurrentWeight:     b.CurrentWeight,
+		})
+		status := &statuses[len(statuses)-1]
+		status.Status, status.Reason = pool.availabilityLocked(b)
+		b.mutex.Unlock()
+	}
+	return statuses
+}
+
+// GetNextBackend picks the backend for a new connection: a matching path
+// route first, then the selection hook, then the configured algorithm. The
+// backend's ActiveConnections is incremented whichever way it was chosen,
+// and the returned release func (safe to call more than once) undoes it.
+func (lb *LoadBalancer) GetNextBackend(clientAddress, path string) (*Backend, int, func()) {
+	backend, idx, release, record := lb.selectBackend(clientAddress, path, nil)
+	record()
+	return backend, idx, release
+}
+
+// selectBackend is GetNextBackend, except that exclude, if set, is treated
+// as unavailable, and that the selection is only counted in the backend's
+// served total, the route metrics and the streak detector once record is
+// called. A hedged dial picks two backends and only records the winner.
+func (lb *LoadBalancer) selectBackend(clientAddress, path string, exclude *Backend) (*Backend, int, func(), func()) {
+	// a reload publishes a new pool, so this one stays consistent for the
+	// whole selection
+	pool := lb.Pool()
+	backends := pool.Backends
+	if len(backends) == 0 {
+		return nil, -1, func() {}, func() {}
+	}
+	var idx int
+	var backend *Backend
+	route := RouteDefault
 
-		for _, b := range lb.Backends {
-			total += b.Weight
+	// path ? path based routing : lb algorithm based routing
+	// the longest matching prefix wins, so /api/v2 beats /api whatever
+	// order the map is iterated in
+	for p, b := range pool.routes {
+		if !strings.HasPrefix(path, p) || (backend != nil && len(p) <= len(route)) {
+			continue
+		}
+		if b == exclude || !pool.selectable(b) {
+			continue
+		}
+		backend = b
+		route = p
+	}
+	if backend != nil {
+		for i, backendCheck := range backends {
+			if backendCheck == backend {
+				idx = i
+				break
+			}
 		}
+	}
+
+	if backend == nil {
+		if hook := lookupSelectionHook(pool.Config.SelectionHook); hook != nil {
+			if i := hook(clientAddress, backends); i >= 0 && i < len(backends) && backends[i] != exclude && pool.selectable(backends[i]) {
+				backend = backends[i]
+				idx = i
+				route = RouteHookPrefix + pool.Config.SelectionHook
+			}
+		}
+	}
+
+	if backend == nil {
+		switch pool.Algo {
+		case RoundRobin:
 
-		maxWeight := -1
+			for attempts := 0; attempts < len(backends); attempts++ {
+				idx = int(uint32(atomic.AddInt32(&lb.Index, 1)) % uint32(len(backends)))
 
-		for i, b := range lb.Backends {
-			b.mutex.Lock()
-			if !b.IsHealthy {
+				candidate := backends[idx]
+
+				if candidate != exclude && pool.selectable(candidate) {
+					backend = candidate
+					break
+				}
+			}
+
+		case LeastConnections:
+			minIdx := -1
+			var minConn int32
+
+			for i, b := range backends {
+				b.mutex.Lock()
+				currConn := b.ActiveConnections
+				ok := b != exclude && pool.selectableLocked(b)
 				b.mutex.Unlock()
-				continue
+
+				if ok && (minIdx == -1 || currConn < minConn) {
+					minConn = currConn
+					minIdx = i
+				}
 			}
 
-			b.CurrentWeight += b.Weight
+			if minIdx != -1 {
+				backend = backends[minIdx]
+				idx = minIdx
+			}
+
+		case IPHash:
+			hashVal := clientHash(clientAddress)
 
-			if b.CurrentWeight > maxWeight {
-				maxWeight = b.CurrentWeight
-				selected = b
-				selectedIdx = i
+			// walk forward from the hashed slot so only clients of an
+			// unroutable backend are remapped
+			start := int(hashVal % uint32(len(backends)))
+			for attempts := 0; attempts < len(backends); attempts++ {
+				idx = (start + attempts) % len(backends)
+				if backends[idx] != exclude && pool.selectable(backends[idx]) {
+					backend = backends[idx]
+					break
+				}
 			}
-			b.mutex.Unlock()
-		}
 
-		if selected != nil {
-			selected.mutex.Lock()
-			selected.CurrentWeight -= total
-			selected.mutex.Unlock()
-			backend = selected
-			idx = selectedIdx
-		}
+		case WeightedRoundRobin:
+			var total int
+			var selected *Backend
+			var selectedIdx int
 
-	default:
-		for attempts := 0; attempts < len(lb.Backends); attempts++ {
-			idx := int(atomic.AddInt32(&lb.Index, 1)) % len(lb.Backends)
+			maxWeight := -1
+
+			// only backends taking part in this round count towards the
+			// total, or the weights of unhealthy ones skew the rest
+			for i, b := range backends {
+				b.mutex.Lock()
+				if b == exclude || !pool.selectableLocked(b) {
+					b.mutex.Unlock()
+					continue
+				}
 
-			candidate := lb.Backends[idx]
+				total += b.Weight
+				b.CurrentWeight += b.Weight
 
-			candidate.mutex.Lock()
-			healthy := candidate.IsHealthy
-			candidate.mutex.Unlock()
-			if healthy {
-				backend = candidate
-				break
+				if b.CurrentWeight > maxWeight {
+					maxWeight = b.CurrentWeight
+					selected = b
+					selectedIdx = i
+				}
+				b.mutex.Unlock()
+			}
+
+			if selected != nil {
+				selected.mutex.Lock()
+				selected.CurrentWeight -= total
+				selected.mutex.Unlock()
+				backend = selected
+				idx = selectedIdx
+			}
+
+		default:
+			for attempts := 0; attempts < len(backends); attempts++ {
+				idx = int(uint32(atomic.AddInt32(&lb.Index, 1)) % uint32(len(backends)))
+
+				candidate := backends[idx]
+
+				if candidate != exclude && pool.selectable(candidate) {
+					backend = candidate
+					break
+				}
 			}
 		}
 	}
 
+	if backend == nil {
+		return nil, -1, func() {}, func() {}
+	}
+
+	// a backend's connection count covers all of its traffic, however it
+	// was selected, so it is only adjusted here and in release
+	selected := backend
+	selected.mutex.Lock()
+	selected.ActiveConnections++
+	selected.mutex.Unlock()
+
 	atomic.AddInt32(&lb.ConnectionCount, 1)
-	atomic.AddInt32(&lb.BackendCounts[idx], 1)
+	record := func() {
+		selected.served.Add(1)
+		metrics.RouteMatchesTotal.WithLabelValues(route).Inc()
+		// path routes and hooks pick the same backend by design
+		if route == RouteDefault {
+			lb.observeSelection(pool, selected)
+		}
+	}
 
+	var once sync.Once
 	release := func() {
-		backend.mutex.Lock()
-		backend.ActiveConnections--
-		backend.mutex.Unlock()
+		once.Do(func() {
+			selected.mutex.Lock()
+			selected.ActiveConnections--
+			selected.mutex.Unlock()
 
-		atomic.AddInt32(&lb.ConnectionCount, -1)
+			atomic.AddInt32(&lb.ConnectionCount, -1)
+			lb.notifyCapacity()
+		})
 	}
 
-	if backend == nil {
-		return nil, -1, func() {}
-	}
+	return backend, idx, release, record
+}
 
-	return backend, idx, release
+// clientHash hashes the IP of clientAddress, so every connection from a
+// client hashes the same whatever its source port.
+func clientHash(clientAddress string) uint32 {
+	host, _, err := net.SplitHostPort(clientAddress)
+	if err != nil {
+		host = clientAddress
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return h.Sum32()
 }
@@ -0,0 +1,348 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestPool(lb *LoadBalancer, algorithm string, addrs ...string) []*Backend {
+	backends := make([]*Backend, 0, len(addrs))
+	for _, addr := range addrs {
+		backends = append(backends, NewBackend(&Backend{Address: addr, Weight: 1}))
+	}
+	lb.SetPool(&UserConfig{Algorithm: algorithm}, backends)
+	return backends
+}
+
+// TestConcurrentSelection routes connections from many goroutines while
+// backends change health and the pool shrinks and grows underneath them.
+func TestConcurrentSelection(t *testing.T) {
+	for _, algorithm := range []string{"round_robin", "least_conn", "ip_hash", "w_round_robin"} {
+		t.Run(algorithm, func(t *testing.T) {
+			lb := &LoadBalancer{}
+			all := newTestPool(lb, algorithm, "a:1", "b:1", "c:1", "d:1", "e:1")
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			for w := 0; w < 8; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
+						backend, idx, release := lb.GetNextBackend(fmt.Sprintf("10.0.0.%d:1", i%256), "/")
+						if backend == nil {
+							continue
+						}
+						if idx < 0 {
+							t.Errorf("selected %s with index %d", backend.Address, idx)
+						}
+						release()
+					}
+				}(w)
+			}
+
+			cfg := lb.Config()
+			for i := 0; i < 500; i++ {
+				setBackendHealth(all[i%len(all)], i%3 != 0)
+				lb.SetPool(cfg, all[:1+i%len(all)])
+			}
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+// TestFailCountsFollowBackend checks that consecutive health failures stay
+// with the backend when a reload reorders the pool.
+func TestFailCountsFollowBackend(t *testing.T) {
+	lb := &LoadBalancer{}
+	backends := newTestPool(lb, "round_robin", "a:1", "b:1")
+	a, b := backends[0], backends[1]
+
+	setBackendHealth(a, false)
+	setBackendHealth(a, false)
+	lb.SetPool(lb.Config(), []*Backend{b, a})
+	setBackendHealth(a, false)
+
+	if got := a.fails.Load(); got != 3 {
+		t.Fatalf("a has %d consecutive fails, want 3", got)
+	}
+	if got := b.fails.Load(); got != 0 {
+		t.Fatalf("b has %d consecutive fails, want 0", got)
+	}
+
+	cfg := &UserConfig{HealthCheckPrioritizeFailing: true}
+	if order := probeOrder(cfg, lb.Pool().Backends); order[0] != 1 {
+		t.Fatalf("probe order %v, want the failing backend a (index 1) first", order)
+	}
+
+	setBackendHealth(a, true)
+	if got := a.fails.Load(); got != 0 {
+		t.Fatalf("a has %d consecutive fails after recovering, want 0", got)
+	}
+}
+
+// TestAvailabilityMatchesSelection puts a backend in each availability
+// state and checks that the reported status agrees with whether selection
+// picks it, through the algorithm and through a path route.
+func TestAvailabilityMatchesSelection(t *testing.T) {
+	tests := []struct {
+		name       string
+		algorithm  string
+		grace      time.Duration
+		setup      func(b *Backend)
+		wantStatus string
+		wantReason string
+	}{
+		{"available", "w_round_robin", 0, func(b *Backend) {}, StatusAvailable, ""},
+		{"unhealthy", "w_round_robin", 0, func(b *Backend) { setBackendHealth(b, false) }, StatusUnavailable, ReasonUnhealthy},
+		{"drain grace", "w_round_robin", time.Hour, func(b *Backend) { setBackendHealth(b, false) }, StatusAvailable, ReasonDrainGrace},
+		{"draining", "w_round_robin", 0, func(b *Backend) { setBackendDraining(b, true) }, StatusUnavailable, ReasonDraining},
+		{"weight zero", "w_round_robin", 0, func(b *Backend) { b.SetWeight(0) }, StatusUnavailable, ReasonWeightZero},
+		{"weight zero outside w_round_robin", "round_robin", 0, func(b *Backend) { b.SetWeight(0) }, StatusAvailable, ""},
+		{"saturated", "w_round_robin", 0, func(b *Backend) { b.SetMaxConns(1) }, StatusUnavailable, ReasonSaturated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := &LoadBalancer{}
+			b := NewBackend(&Backend{Address: "a:1", Weight: 1, Paths: []string{"/a"}})
+			lb.SetPool(&UserConfig{Algorithm: tt.algorithm, DrainGracePeriod: Duration(tt.grace)}, []*Backend{b})
+			if tt.wantReason == ReasonSaturated {
+				_, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+				defer release()
+			}
+			tt.setup(b)
+
+			status := lb.Snapshot()[0]
+			if status.Status != tt.wantStatus || status.Reason != tt.wantReason {
+				t.Fatalf("status %s/%s, want %s/%s", status.Status, status.Reason, tt.wantStatus, tt.wantReason)
+			}
+
+			// drain grace only picks a backend with a falling probability,
+			// which starts at 1
+			wantPicked := tt.wantStatus == StatusAvailable
+			for _, path := range []string{"/", "/a/x"} {
+				picked, _, release := lb.GetNextBackend("10.0.0.2:1", path)
+				release()
+				if (picked != nil) != wantPicked {
+					t.Errorf("GetNextBackend(%q) picked %v, want picked=%v", path, picked, wantPicked)
+				}
+			}
+		})
+	}
+}
+
+// TestWeightZeroNeverPickedByWRR checks that under w_round_robin a
+// weight-0 backend gets no connections, even when every weight is 0.
+func TestWeightZeroNeverPickedByWRR(t *testing.T) {
+	lb := &LoadBalancer{}
+	zero := NewBackend(&Backend{Address: "zero:1", Weight: 0})
+	one := NewBackend(&Backend{Address: "one:1", Weight: 1})
+	lb.SetPool(&UserConfig{Algorithm: "w_round_robin"}, []*Backend{zero, one})
+	for i := 0; i < 10; i++ {
+		b, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+		release()
+		if b != one {
+			t.Fatalf("selection %d picked %v, want %s", i, b, one.Address)
+		}
+	}
+
+	one.SetWeight(0)
+	if b, _, release := lb.GetNextBackend("10.0.0.1:1", "/"); b != nil {
+		release()
+		t.Fatalf("picked %s with every weight 0", b.Address)
+	}
+}
+
+// TestBackendLocksNotCopied builds backends the way the config path does and
+// checks that the pool shares each runtime backend's lock instead of a copy.
+func TestBackendLocksNotCopied(t *testing.T) {
+	var cfg UserConfig
+	if err := json.Unmarshal([]byte(`{"algorithm": "w_round_robin", "Backends": [{"address": "a:1", "weight": 1}, {"address": "b:1", "weight": 2}]}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]*Backend, 0, len(cfg.Backends))
+	for _, b := range cfg.Backends {
+		backends = append(backends, NewBackend(b))
+	}
+	lb := &LoadBalancer{}
+	lb.SetPool(&cfg, backends)
+
+	held := lb.Pool().Backends[1]
+	if held != backends[1] {
+		t.Fatal("pool holds a different backend than the one built for it")
+	}
+	held.mutex.Lock()
+	if !cfg.Backends[1].mutex.TryLock() {
+		t.Fatal("config backend shares its lock with the runtime backend")
+	}
+	cfg.Backends[1].mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lb.Snapshot()
+	}()
+	select {
+	case <-done:
+		t.Fatal("Snapshot ran while the backend was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	held.mutex.Unlock()
+	<-done
+
+	for _, b := range lb.Pool().Backends {
+		if !b.mutex.TryLock() {
+			t.Fatalf("backend %s left locked", b.Address)
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// TestDrainGraceShareDecays checks that a backend that just turned unhealthy
+// keeps a share of new connections that shrinks over drain_grace_period
+// instead of dropping to nothing at once.
+func TestDrainGraceShareDecays(t *testing.T) {
+	const grace = time.Minute
+	lb := &LoadBalancer{}
+	b := NewBackend(&Backend{Address: "a:1"})
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", DrainGracePeriod: Duration(grace)}, []*Backend{b})
+	setBackendHealth(b, false)
+
+	const trials = 4000
+	for _, tt := range []struct {
+		elapsed time.Duration
+		share   float64
+	}{
+		{0, 1},
+		{grace / 4, 0.75},
+		{grace / 2, 0.5},
+		{grace * 3 / 4, 0.25},
+		{grace, 0},
+	} {
+		b.mutex.Lock()
+		b.UnhealthySince = time.Now().Add(-tt.elapsed)
+		b.mutex.Unlock()
+
+		picked := 0
+		for i := 0; i < trials; i++ {
+			if lb.Pool().selectable(b) {
+				picked++
+			}
+		}
+		share := float64(picked) / trials
+		if share < tt.share-0.05 || share > tt.share+0.05 {
+			t.Errorf("%s into the grace period the backend got %.2f of connections, want about %.2f", tt.elapsed, share, tt.share)
+		}
+	}
+}
+
+// TestPathRouteAndAlgorithmShareCounters selects the same backend through a
+// path route and through the algorithm and checks both count against the
+// one backend and release back to zero, in any order and more than once.
+func TestPathRouteAndAlgorithmShareCounters(t *testing.T) {
+	lb := &LoadBalancer{}
+	b := NewBackend(&Backend{Address: "a:1", Paths: []string{"/a"}})
+	lb.SetPool(&UserConfig{Algorithm: "least_conn"}, []*Backend{b})
+
+	var releases []func()
+	for _, path := range []string{"/a/x", "/", "/a", "/other"} {
+		picked, _, release := lb.GetNextBackend("10.0.0.1:1", path)
+		if picked != b {
+			t.Fatalf("%s went to %v, want %s", path, picked, b.Address)
+		}
+		releases = append(releases, release)
+	}
+	if got := lb.Snapshot()[0].ActiveConnections; got != 4 {
+		t.Fatalf("backend has %d active connections, want 4", got)
+	}
+	if got := b.served.Load(); got != 4 {
+		t.Fatalf("backend served %d connections, want 4", got)
+	}
+
+	for i := len(releases) - 1; i >= 0; i-- {
+		releases[i]()
+		releases[i]()
+	}
+	if got := lb.Snapshot()[0].ActiveConnections; got != 0 {
+		t.Fatalf("backend has %d active connections after every release, want 0", got)
+	}
+}
+
+// TestRoundRobinStartsAtIndex checks that balancers seeded with different
+// starting indexes, as instances started together are, begin round robin
+// at different backends and then cover the whole pool.
+func TestRoundRobinStartsAtIndex(t *testing.T) {
+	addrs := []string{"a:1", "b:1", "c:1", "d:1"}
+	rng := rand.New(rand.NewSource(1))
+	starts := map[string]bool{}
+	for i := 0; i < 8; i++ {
+		lb := &LoadBalancer{Index: rng.Int31()}
+		newTestPool(lb, "round_robin", addrs...)
+
+		seen := map[string]bool{}
+		for j := 0; j < len(addrs); j++ {
+			b, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+			release()
+			if j == 0 {
+				starts[b.Address] = true
+			}
+			seen[b.Address] = true
+		}
+		if len(seen) != len(addrs) {
+			t.Fatalf("round robin from index %d covered %d of %d backends", lb.Index, len(seen), len(addrs))
+		}
+	}
+	if len(starts) < 2 {
+		t.Fatalf("8 randomly seeded balancers all started at %v", starts)
+	}
+
+	first := func(index int32) string {
+		lb := &LoadBalancer{Index: index}
+		newTestPool(lb, "round_robin", addrs...)
+		b, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+		release()
+		return b.Address
+	}
+	if first(0) == first(1) {
+		t.Fatal("balancers seeded with indexes 0 and 1 started at the same backend")
+	}
+}
+
+// BenchmarkGetNextBackend measures one selection from a pool of 5000
+// backends under each algorithm, so the cost of the ones that scan the
+// whole pool can be compared against round_robin and ip_hash.
+func BenchmarkGetNextBackend(b *testing.B) {
+	addrs := make([]string, 5000)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.%d.%d:80", i/256, i%256)
+	}
+	clients := make([]string, 256)
+	for i := range clients {
+		clients[i] = fmt.Sprintf("192.168.0.%d:40000", i)
+	}
+	for _, algorithm := range []string{"round_robin", "least_conn", "ip_hash", "w_round_robin"} {
+		b.Run(algorithm, func(b *testing.B) {
+			lb := &LoadBalancer{}
+			newTestPool(lb, algorithm, addrs...)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				backend, _, release := lb.GetNextBackend(clients[i%len(clients)], "/")
+				if backend == nil {
+					b.Fatal("no backend selected")
+				}
+				release()
+			}
+		})
+	}
+}
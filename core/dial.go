@@ -0,0 +1,183 @@
+package core
+
+import (
+	"Akash/logging"
+	"Akash/metrics"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ErrNoBackend is returned when no backend is available to serve a client.
+var ErrNoBackend = errors.New("no backend available")
+
+// defaultDialTimeout bounds connecting to a backend, TLS handshake
+// included, when timeout is not set.
+const defaultDialTimeout = 5 * time.Second
+
+// backendDialTimeout returns how long connecting to a backend may take.
+func (c *UserConfig) backendDialTimeout() time.Duration {
+	if timeout := c.DialTimeout(); timeout > 0 {
+		return timeout
+	}
+	return defaultDialTimeout
+}
+
+type dialResult struct {
+	conn    net.Conn
+	backend *Backend
+	release func()
+	// record counts the selection of backend; only the dial that is used
+	// calls it
+	record func()
+	err    error
+}
+
+// DialBackend selects a backend for the client and connects to it. When
+// hedge_after is configured and the chosen backend hasn't completed the TCP
+// handshake in time (or fails outright), a second backend is dialed and
+// whichever connects first is used; the loser is closed and released.
+func (lb *LoadBalancer) DialBackend(clientAddress, path string) (net.Conn, *Backend, func(), error) {
+	return lb.dialBackend(clientAddress, path, nil)
+}
+
+// dialBackend is DialBackend, except that exclude, if set, is never dialed.
+func (lb *LoadBalancer) dialBackend(clientAddress, path string, exclude *Backend) (net.Conn, *Backend, func(), error) {
+	primary, _, release, record := lb.selectBackend(clientAddress, path, exclude)
+	if primary == nil {
+		return nil, nil, nil, ErrNoBackend
+	}
+
+	dialer, err := lb.backendDialer(clientAddress)
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+
+	hedgeAfter := lb.Config().HedgeAfter.Duration()
+	if hedgeAfter <= 0 {
+		r := dialOne(dialer, primary, release, record)
+		if r.err != nil {
+			return nil, nil, nil, r.err
+		}
+		r.record()
+		return r.conn, r.backend, r.release, nil
+	}
+
+	results := make(chan dialResult, 2)
+	go func() { results <- dialOne(dialer, primary, release, record) }()
+	pending := 1
+	hedged := false
+
+	hedge := func() {
+		hedged = true
+		secondary, _, releaseSecondary, recordSecondary := lb.selectBackend(clientAddress, path, exclude)
+		if secondary == nil {
+			return
+		}
+		if secondary == primary {
+			releaseSecondary()
+			return
+		}
+		logging.Infof("Hedging dial for %s: %s -> %s", clientAddress, primary.Address, secondary.Address)
+		pending++
+		go func() { results <- dialOne(dialer, secondary, releaseSecondary, recordSecondary) }()
+	}
+
+	timer := time.NewTimer(hedgeAfter)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				r.record()
+				go discardDials(results, pending)
+				return r.conn, r.backend, r.release, nil
+			}
+			lastErr = r.err
+			if !hedged {
+				hedge()
+			}
+		case <-timer.C:
+			if !hedged {
+				hedge()
+			}
+		}
+	}
+	return nil, nil, nil, lastErr
+}
+
+// dialOne connects to backend, recording a failure and releasing the
+// selection if the dial fails. The selection itself is left for the caller
+// to record once it uses the connection. Backends with TLS set are connected to over
+// TLS, including the handshake, all within the dialer's timeout.
+func dialOne(dialer *net.Dialer, backend *Backend, release, record func()) dialResult {
+	ctx, cancel := context.WithTimeout(context.Background(), dialer.Timeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "tcp", backend.Address)
+	if err == nil && backend.TLS {
+		conn, err = tlsHandshake(ctx, conn, backend.Address)
+	}
+	if err != nil {
+		logging.Limited.Errorf("Failed to connect backend %s: %v", backend.Address, err)
+		metrics.PerBackendFails.WithLabelValues(backend.Address).Inc()
+		release()
+		return dialResult{backend: backend, err: err}
+	}
+	return dialResult{conn: conn, backend: backend, release: release, record: record}
+}
+
+func tlsHandshake(ctx context.Context, conn net.Conn, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// backendDialer returns the dialer for backend connections. In transparent
+// mode the connection is bound to the client's address, so the backend sees
+// the client as the source; see tproxy_linux.go for the kernel setup this needs.
+func (lb *LoadBalancer) backendDialer(clientAddress string) (*net.Dialer, error) {
+	cfg := lb.Config()
+	dialer := &net.Dialer{Timeout: cfg.backendDialTimeout()}
+	if !cfg.Transparent {
+		return dialer, nil
+	}
+
+	host, _, err := net.SplitHostPort(clientAddress)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("transparent mode: invalid client address %s", clientAddress)
+	}
+	dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	dialer.Control = transparentControl
+	return dialer, nil
+}
+
+// discardDials closes and releases connections from hedged dials that lost
+// the race.
+func discardDials(results <-chan dialResult, pending int) {
+	for ; pending > 0; pending-- {
+		r := <-results
+		if r.err == nil {
+			r.conn.Close()
+			r.release()
+		}
+	}
+}
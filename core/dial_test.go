@@ -0,0 +1,101 @@
+package core
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackendDialTimeout(t *testing.T) {
+	if got := (&UserConfig{}).backendDialTimeout(); got != defaultDialTimeout {
+		t.Errorf("default backend dial timeout = %s, want %s", got, defaultDialTimeout)
+	}
+	if got := (&UserConfig{Timeout: Duration(time.Second)}).backendDialTimeout(); got != time.Second {
+		t.Errorf("backend dial timeout = %s, want 1s", got)
+	}
+}
+
+// TestDialBackendTLSHandshakeTimeout dials a TLS backend that accepts the
+// connection and never answers the handshake.
+func TestDialBackendTLSHandshakeTimeout(t *testing.T) {
+	lb := &LoadBalancer{}
+	backend := NewBackend(&Backend{Address: hangingListener(t), TLS: true})
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", Timeout: Duration(200 * time.Millisecond)}, []*Backend{backend})
+
+	start := time.Now()
+	conn, _, _, err := lb.DialBackend("10.0.0.1:1234", "/")
+	if err == nil {
+		conn.Close()
+		t.Fatal("DialBackend succeeded against a backend that never completes the handshake")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("DialBackend took %s, want it bounded by the 200ms timeout", elapsed)
+	}
+	if n := lb.ConnectionCount; n != 0 {
+		t.Fatalf("ConnectionCount = %d after a failed dial, want 0", n)
+	}
+}
+
+// TestHedgedDialUsesFasterBackend dials a primary that never finishes its
+// TLS handshake and checks the hedge to a fast secondary is what the
+// client gets, that the loser is released once its dial gives up and that
+// only the winner is counted.
+func TestHedgedDialUsesFasterBackend(t *testing.T) {
+	fast, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	go func() {
+		for {
+			conn, err := fast.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	lb := &LoadBalancer{}
+	secondary := NewBackend(&Backend{Address: fast.Addr().String()})
+	slow := NewBackend(&Backend{Address: hangingListener(t), TLS: true})
+	// round robin starts at index 1, so the slow backend is the primary
+	lb.SetPool(&UserConfig{
+		Algorithm:  "round_robin",
+		HedgeAfter: Duration(50 * time.Millisecond),
+		Timeout:    Duration(500 * time.Millisecond),
+	}, []*Backend{secondary, slow})
+	before := routeMatches(t)[RouteDefault]
+
+	start := time.Now()
+	conn, backend, release, err := lb.DialBackend("10.0.0.1:1234", "/")
+	if err != nil {
+		t.Fatalf("hedged dial failed: %v", err)
+	}
+	defer conn.Close()
+	defer release()
+	if backend != secondary {
+		t.Fatalf("client got %s, want the fast secondary %s", backend.Address, secondary.Address)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Fatalf("hedged dial took %s, want it to finish well before the primary times out", elapsed)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lb.Snapshot()[1].ActiveConnections != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("losing primary was never released")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&lb.ConnectionCount); got != 1 {
+		t.Fatalf("ConnectionCount = %d with one connection in use, want 1", got)
+	}
+	if s, p := secondary.served.Load(), slow.served.Load(); s != 1 || p != 0 {
+		t.Fatalf("served counts secondary=%d primary=%d, want only the winner counted", s, p)
+	}
+	if got := routeMatches(t)[RouteDefault] - before; got != 1 {
+		t.Fatalf("default route counted %v times for one connection, want 1", got)
+	}
+}
@@ -0,0 +1,53 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Duration is a time.Duration that can be decoded from JSON either as a
+// duration string ("250ms", "2s") or as a plain number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return durationError(fmt.Sprintf("string %q", value))
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case nil:
+		*d = 0
+	case bool:
+		return durationError("bool")
+	case []interface{}:
+		return durationError("array")
+	default:
+		return durationError("object")
+	}
+	return nil
+}
+
+// durationError reports an unusable duration the way encoding/json reports
+// a type mismatch, so the decoder fills in the field it belongs to.
+func durationError(value string) error {
+	return &json.UnmarshalTypeError{Value: value, Type: reflect.TypeOf(Duration(0))}
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{`"250ms"`, 250 * time.Millisecond, false},
+		{`"2s"`, 2 * time.Second, false},
+		{`"1m30s"`, 90 * time.Second, false},
+		{`3`, 3 * time.Second, false},
+		{`0.5`, 500 * time.Millisecond, false},
+		{`null`, 0, false},
+		{`"abc"`, 0, true},
+		{`true`, 0, true},
+	}
+	for _, tt := range tests {
+		var d Duration
+		err := json.Unmarshal([]byte(tt.in), &d)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("Unmarshal(%s) error %v, want error=%v", tt.in, err, tt.wantErr)
+		}
+		if err == nil && d.Duration() != tt.want {
+			t.Errorf("Unmarshal(%s) = %s, want %s", tt.in, d.Duration(), tt.want)
+		}
+	}
+}
+
+// TestLegacySecondsFields checks that the deprecated integer-seconds fields
+// still apply, and that the duration fields win when both are set.
+func TestLegacySecondsFields(t *testing.T) {
+	tests := []struct {
+		config             string
+		wantDial, wantFreq time.Duration
+	}{
+		{`{"timeout": "250ms", "health_check_interval": "1500ms"}`, 250 * time.Millisecond, 1500 * time.Millisecond},
+		{`{"timeout_seconds": 3, "health_check_freq": 7}`, 3 * time.Second, 7 * time.Second},
+		{`{"timeout": "250ms", "timeout_seconds": 3, "health_check_interval": "2s", "health_check_freq": 7}`, 250 * time.Millisecond, 2 * time.Second},
+		{`{}`, 0, defaultHealthCheckFreq},
+	}
+	for _, tt := range tests {
+		var cfg UserConfig
+		if err := json.Unmarshal([]byte(tt.config), &cfg); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", tt.config, err)
+		}
+		if got := cfg.DialTimeout(); got != tt.wantDial {
+			t.Errorf("%s: DialTimeout() = %s, want %s", tt.config, got, tt.wantDial)
+		}
+		if got := cfg.HealthCheckFrequency(); got != tt.wantFreq {
+			t.Errorf("%s: HealthCheckFrequency() = %s, want %s", tt.config, got, tt.wantFreq)
+		}
+	}
+}
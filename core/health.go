@@ -1,55 +1,351 @@
 package core
 
 import (
-	"log"
+	"Akash/logging"
+	"context"
+	"io"
 	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
-func StartHealthChecks(lb *LoadBalancer) {
-	freq := time.Duration(lb.Config.HealthCheckFreq) * time.Second
+// StartHealthChecks probes the backends in the background until ctx is
+// cancelled. Cancelling also aborts probes in flight, whose results are
+// discarded. The returned channel is closed once the checker has stopped.
+func StartHealthChecks(ctx context.Context, lb *LoadBalancer) <-chan struct{} {
+	freq := lb.Config().HealthCheckFrequency()
+	done := make(chan struct{})
 
-	if freq == 0 {
-		freq = freq * 19
+	go func() {
+		defer close(done)
+		alerter := newHealthAlerter()
+		for ctx.Err() == nil {
+			runHealthCheckCycle(ctx, lb, freq)
+			if ctx.Err() != nil {
+				break
+			}
+			healthy, total := lb.HealthyCount()
+			alerter.observe(lb.Config(), healthy, total, time.Now())
+		}
+		logging.Infof("Health checks stopped")
+	}()
+	return done
+}
+
+// Warmup probes every backend once before Akash starts serving, at most
+// warmup_concurrency at a time, so the first connections avoid backends
+// that are already down without the whole fleet being hit at once. Each
+// wave finishes before the next starts and progress is logged per wave.
+// It does nothing when warmup_concurrency is not set.
+func Warmup(ctx context.Context, lb *LoadBalancer) {
+	pool := lb.Pool()
+	wave := pool.Config.WarmupConcurrency
+	backends := pool.Backends
+	if wave <= 0 || len(backends) == 0 {
+		return
 	}
 
-	go func() {
-		for {
-			for i, backend := range lb.Backends {
-				go checkBackend(backend, lb, i)
+	start := time.Now()
+	var healthy atomic.Int32
+	for from := 0; from < len(backends); from += wave {
+		to := min(from+wave, len(backends))
+		var probes sync.WaitGroup
+		for i := from; i < to; i++ {
+			probes.Add(1)
+			go func(backend *Backend) {
+				defer probes.Done()
+				checkBackend(ctx, backend, pool.Config)
+				if pool.routable(backend) {
+					healthy.Add(1)
+				}
+			}(backends[i])
+		}
+		probes.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+		logging.Infof("Warmup: probed %d/%d backends, %d healthy", to, len(backends), healthy.Load())
+	}
+	logging.Infof("Warmup finished in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// sleepContext waits for d and reports whether ctx is still live.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// maxHealthCheckSteps caps how many separate launch points a health check
+// cycle is spread over.
+const maxHealthCheckSteps = 100
+
+// runHealthCheckCycle probes every backend once, spreading the probes evenly
+// across freq so the fleet doesn't see a synchronized burst of connections.
+// With health_check_concurrency set, at most that many probes run at once.
+// It returns early, once the probes it started have finished, when ctx is
+// cancelled.
+func runHealthCheckCycle(ctx context.Context, lb *LoadBalancer, freq time.Duration) {
+	pool := lb.Pool()
+	backends := pool.Backends
+	if len(backends) == 0 {
+		sleepContext(ctx, freq)
+		return
+	}
+
+	var sem chan struct{}
+	if pool.Config.HealthCheckConcurrency > 0 {
+		sem = make(chan struct{}, pool.Config.HealthCheckConcurrency)
+	}
+
+	// large fleets are probed in batches so the pause between launches
+	// stays well above timer resolution; each batch, the last one too,
+	// is followed by one pause
+	steps := min(len(backends), maxHealthCheckSteps)
+	batch := (len(backends) + steps - 1) / steps
+	batches := (len(backends) + batch - 1) / batch
+	step := freq / time.Duration(batches)
 
+	var inflight sync.WaitGroup
+	defer inflight.Wait()
+
+	for n, i := range probeOrder(pool.Config, backends) {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
 			}
-			time.Sleep(freq)
 		}
-	}()
+		inflight.Add(1)
+		go func(backend *Backend) {
+			defer inflight.Done()
+			if sem != nil {
+				defer func() { <-sem }()
+			}
+			checkBackend(ctx, backend, pool.Config)
+		}(backends[i])
+		if ((n+1)%batch == 0 || n+1 == len(backends)) && !sleepContext(ctx, step) {
+			return
+		}
+	}
+}
+
+// probeOrder returns the indexes of backends in the order they should be
+// probed. With health_check_prioritize_failing set, unhealthy backends and
+// those with the most consecutive failures go first so outages and
+// recoveries are noticed sooner.
+func probeOrder(cfg *UserConfig, backends []*Backend) []int {
+	order := make([]int, len(backends))
+	for i := range order {
+		order[i] = i
+	}
+	if !cfg.HealthCheckPrioritizeFailing {
+		return order
+	}
+
+	healthy := make([]bool, len(backends))
+	fails := make([]int32, len(backends))
+	for i, b := range backends {
+		b.mutex.Lock()
+		healthy[i] = b.IsHealthy
+		b.mutex.Unlock()
+		fails[i] = b.fails.Load()
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if healthy[i] != healthy[j] {
+			return !healthy[i]
+		}
+		return fails[i] > fails[j]
+	})
+	return order
+}
+
+// defaultProbeTimeout bounds a health probe when timeout is not set.
+const defaultProbeTimeout = 5 * time.Second
+
+// probeTimeout returns how long a single health probe may take: timeout, or
+// defaultProbeTimeout when it is not set, but never longer than the health
+// check interval, so a backend that hangs can't hold up the next cycle.
+func (c *UserConfig) probeTimeout() time.Duration {
+	timeout := c.DialTimeout()
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+	return min(timeout, c.HealthCheckFrequency())
 }
 
-func checkBackend(backend *Backend, lb *LoadBalancer, index int) {
-	timeout := time.Duration(lb.Config.TimeoutSeconds) * time.Second
-	conn, err := net.DialTimeout("tcp", backend.Address, timeout)
+func checkBackend(ctx context.Context, backend *Backend, cfg *UserConfig) {
+	probeCtx, cancel := context.WithTimeout(ctx, cfg.probeTimeout())
+	defer cancel()
+
+	if path := healthCheckPath(backend, cfg); path != "" {
+		healthy, draining := probeHTTP(probeCtx, backend, cfg, path)
+		// a probe cut short by shutdown says nothing about the backend
+		if ctx.Err() != nil {
+			return
+		}
+		setBackendDraining(backend, draining)
+		setBackendHealth(backend, applyHealthScore(backend, cfg, healthy))
+		return
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(probeCtx, "tcp", backend.Address)
+	if ctx.Err() != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
 
 	if err != nil {
-		setBackendHealth(backend, false, lb, index)
+		setBackendHealth(backend, applyHealthScore(backend, cfg, false))
 		return
 	}
 
 	conn.Close()
-	setBackendHealth(backend, true, lb, index)
+	setBackendHealth(backend, applyHealthScore(backend, cfg, true))
+}
+
+// applyHealthScore folds a probe result into the backend's EWMA health
+// score and returns whether the backend should now be considered healthy.
+// A healthy backend only goes down once the score drops below
+// health_score_down and an unhealthy one only comes back above
+// health_score_up, so a backend whose probes flap keeps a stable state.
+// Without health_score_alpha the probe result is used as is.
+func applyHealthScore(backend *Backend, cfg *UserConfig, probeOK bool) bool {
+	alpha := cfg.HealthScoreAlpha
+	if alpha <= 0 || alpha > 1 {
+		return probeOK
+	}
+	up, down := cfg.healthScoreThresholds()
+
+	sample := 0.0
+	if probeOK {
+		sample = 1
+	}
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	backend.HealthScore = alpha*sample + (1-alpha)*backend.HealthScore
+	switch {
+	case backend.IsHealthy && backend.HealthScore < down:
+		return false
+	case !backend.IsHealthy && backend.HealthScore >= up:
+		return true
+	default:
+		return backend.IsHealthy
+	}
+}
+
+// probeHTTP checks backend with a GET to path.
+// A response matching health_check_drain_status or carrying
+// health_check_drain_header reports the backend as healthy but draining;
+// any other 2xx or 3xx response is healthy.
+func probeHTTP(ctx context.Context, backend *Backend, cfg *UserConfig, path string) (healthy, draining bool) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, healthCheckURL(backend, cfg, path), nil)
+	if err != nil {
+		return false, false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, false
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if cfg.HealthCheckDrainStatus != 0 && resp.StatusCode == cfg.HealthCheckDrainStatus {
+		return true, true
+	}
+	if cfg.HealthCheckDrainHeader != "" && resp.Header.Get(cfg.HealthCheckDrainHeader) != "" {
+		return true, true
+	}
+	return resp.StatusCode >= 200 && resp.StatusCode < 400, false
+}
+
+// healthCheckPath returns the HTTP health check path for backend: its own
+// health_check_path if set, otherwise the global one. An empty path means a
+// plain TCP check.
+func healthCheckPath(backend *Backend, cfg *UserConfig) string {
+	backend.mutex.Lock()
+	path := backend.HealthCheckPath
+	backend.mutex.Unlock()
+	if path != "" {
+		return path
+	}
+	return cfg.HealthCheckPath
+}
+
+func healthCheckURL(backend *Backend, cfg *UserConfig, path string) string {
+	host, port, err := net.SplitHostPort(backend.Address)
+	if err != nil {
+		host = backend.Address
+	}
+	if cfg.HealthCheckPort != "" {
+		port = cfg.HealthCheckPort
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	scheme := "http://"
+	if backend.TLS {
+		scheme = "https://"
+	}
+	return scheme + host + path
 }
 
-func setBackendHealth(backend *Backend, healthy bool, lb *LoadBalancer, index int) {
+func setBackendDraining(backend *Backend, draining bool) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.Draining != draining {
+		logging.Infof("Backend %s draining changed → %v", backend.Address, draining)
+	}
+	backend.Draining = draining
+}
+
+func setBackendHealth(backend *Backend, healthy bool) {
 
 	backend.mutex.Lock()
 
 	defer backend.mutex.Unlock()
 
 	if backend.IsHealthy != healthy {
-		log.Printf("Backend %s health changed → %v", backend.Address, healthy)
+		logging.Infof("Backend %s health changed → %v", backend.Address, healthy)
+		if healthy {
+			backend.UnhealthySince = time.Time{}
+		} else {
+			backend.UnhealthySince = time.Now()
+		}
 	}
 	backend.IsHealthy = healthy
 
 	if healthy {
-		atomic.StoreInt32(&lb.BackendFails[index], 0)
+		backend.fails.Store(0)
+	} else {
+		backend.fails.Add(1)
 	}
 }
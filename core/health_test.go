@@ -0,0 +1,424 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hangingListener accepts connections and never answers on them.
+func hangingListener(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		<-done
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	return ln.Addr().String()
+}
+
+func TestProbeTimeout(t *testing.T) {
+	tests := []struct {
+		cfg  UserConfig
+		want time.Duration
+	}{
+		{UserConfig{}, defaultProbeTimeout},
+		{UserConfig{Timeout: Duration(time.Second)}, time.Second},
+		{UserConfig{HealthCheckInterval: Duration(time.Second)}, time.Second},
+		{UserConfig{Timeout: Duration(time.Minute), HealthCheckInterval: Duration(2 * time.Second)}, 2 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := tt.cfg.probeTimeout(); got != tt.want {
+			t.Errorf("probeTimeout() with timeout=%s interval=%s = %s, want %s", tt.cfg.Timeout.Duration(), tt.cfg.HealthCheckInterval.Duration(), got, tt.want)
+		}
+	}
+}
+
+// TestHungBackendDoesNotStallCycle checks that a backend that accepts the
+// probe and never answers is marked down within the interval instead of
+// holding up the health check cycle.
+func TestHungBackendDoesNotStallCycle(t *testing.T) {
+	lb := &LoadBalancer{}
+	backends := []*Backend{NewBackend(&Backend{Address: hangingListener(t)})}
+	lb.SetPool(&UserConfig{
+		Algorithm:           "round_robin",
+		HealthCheckPath:     "/health",
+		HealthCheckInterval: Duration(200 * time.Millisecond),
+	}, backends)
+
+	start := time.Now()
+	runHealthCheckCycle(context.Background(), lb, 200*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("health check cycle took %s with a hung backend", elapsed)
+	}
+	if backends[0].Routable() {
+		t.Fatal("hung backend is still routable")
+	}
+}
+
+// TestHealthCheckCycleSpansInterval checks that a cycle spreads its probes
+// over the whole interval, for fleets that fit in one launch per backend
+// and for ones probed in batches, including a partial last batch.
+func TestHealthCheckCycleSpansInterval(t *testing.T) {
+	const freq = 500 * time.Millisecond
+	for _, n := range []int{3, 151, 5000} {
+		t.Run(fmt.Sprint(n), func(t *testing.T) {
+			backends := make([]*Backend, n)
+			for i := range backends {
+				// nothing listens on port 1, so probes fail at once
+				backends[i] = NewBackend(&Backend{Address: "127.0.0.1:1"})
+			}
+			lb := &LoadBalancer{}
+			lb.SetPool(&UserConfig{Algorithm: "round_robin"}, backends)
+
+			start := time.Now()
+			runHealthCheckCycle(context.Background(), lb, freq)
+			elapsed := time.Since(start)
+			if elapsed < freq*9/10 || elapsed > freq*2 {
+				t.Fatalf("cycle over %d backends took %s, want about %s", n, elapsed, freq)
+			}
+			for _, b := range backends {
+				if b.Routable() {
+					t.Fatalf("backend %s was not probed", b.Address)
+				}
+			}
+		})
+	}
+}
+
+// TestProbeStartsSpreadOverInterval records when each backend is probed and
+// checks the probes are evenly spaced rather than fired together.
+func TestProbeStartsSpreadOverInterval(t *testing.T) {
+	const (
+		n    = 5
+		freq = 500 * time.Millisecond
+	)
+	probed := make(chan time.Time, n)
+	backends := make([]*Backend, n)
+	for i := range backends {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			probed <- time.Now()
+			conn.Close()
+		}()
+		backends[i] = NewBackend(&Backend{Address: ln.Addr().String()})
+	}
+	lb := &LoadBalancer{}
+	lb.SetPool(&UserConfig{Algorithm: "round_robin"}, backends)
+
+	start := time.Now()
+	runHealthCheckCycle(context.Background(), lb, freq)
+
+	step := freq / n
+	last := start
+	for i := 0; i < n; i++ {
+		at := <-probed
+		offset := at.Sub(start)
+		if want := time.Duration(i) * step; offset < want-step/2 || offset > want+step/2 {
+			t.Fatalf("probe %d started at %s, want about %s", i, offset, want)
+		}
+		last = at
+	}
+	if spread := last.Sub(start); spread < freq/2 {
+		t.Fatalf("probes all started within %s of a %s interval", spread, freq)
+	}
+}
+
+// TestFailingBackendsProbedFirst runs a cycle with one probe at a time and
+// checks that the backends that failed most recently are probed first.
+func TestFailingBackendsProbedFirst(t *testing.T) {
+	probed := make(chan string, 4)
+	backends := make([]*Backend, 4)
+	for i := range backends {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		addr := ln.Addr().String()
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			probed <- addr
+			conn.Close()
+		}()
+		backends[i] = NewBackend(&Backend{Address: addr})
+	}
+	setBackendHealth(backends[3], false)
+	setBackendHealth(backends[2], false)
+	setBackendHealth(backends[2], false)
+
+	lb := &LoadBalancer{}
+	lb.SetPool(&UserConfig{
+		Algorithm:                    "round_robin",
+		HealthCheckConcurrency:       1,
+		HealthCheckPrioritizeFailing: true,
+	}, backends)
+	runHealthCheckCycle(context.Background(), lb, 200*time.Millisecond)
+
+	for i, want := range []*Backend{backends[2], backends[3], backends[0], backends[1]} {
+		if got := <-probed; got != want.Address {
+			t.Fatalf("probe %d went to %s, want %s", i, got, want.Address)
+		}
+	}
+}
+
+// TestDrainingBackendKeepsExistingConnections has a backend report draining
+// on its health endpoint and checks it gets no new connections while the
+// one it already has is left alone.
+func TestDrainingBackendKeepsExistingConnections(t *testing.T) {
+	var draining atomic.Bool
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer health.Close()
+
+	lb := &LoadBalancer{}
+	drained := NewBackend(&Backend{Address: strings.TrimPrefix(health.URL, "http://")})
+	other := NewBackend(&Backend{Address: "other:1"})
+	cfg := &UserConfig{Algorithm: "least_conn", HealthCheckPath: "/health", HealthCheckDrainStatus: http.StatusServiceUnavailable}
+	lb.SetPool(cfg, []*Backend{drained, other})
+
+	existing, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+	defer release()
+	if existing != drained {
+		t.Fatalf("first connection went to %s, want %s", existing.Address, drained.Address)
+	}
+
+	draining.Store(true)
+	checkBackend(context.Background(), drained, cfg)
+	status := lb.Snapshot()[0]
+	if !status.Healthy || !status.Draining || status.Reason != ReasonDraining {
+		t.Fatalf("status after the drain signal %+v, want healthy and draining", status)
+	}
+	if status.ActiveConnections != 1 {
+		t.Fatalf("draining backend has %d active connections, want the existing 1", status.ActiveConnections)
+	}
+	for i := 0; i < 10; i++ {
+		b, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+		release()
+		if b != other {
+			t.Fatalf("new connection %d went to %v while %s was draining", i, b, drained.Address)
+		}
+	}
+
+	draining.Store(false)
+	checkBackend(context.Background(), drained, cfg)
+	if !drained.Routable() {
+		t.Fatal("backend still not routable after it stopped draining")
+	}
+}
+
+// TestHealthScoreSmoothsFlapping feeds alternating probe results and checks
+// the EWMA decision holds steady in both directions where the raw results
+// would flip every probe, while a sustained change still goes through.
+func TestHealthScoreSmoothsFlapping(t *testing.T) {
+	cfg := &UserConfig{HealthScoreAlpha: 0.3, HealthScoreUp: 0.7, HealthScoreDown: 0.3}
+	noisy := []bool{true, false, true, false, false, true, false, true, true, false, true, false}
+
+	for _, start := range []bool{true, false} {
+		b := NewBackend(&Backend{Address: "a:1"})
+		if !start {
+			b.HealthScore = 0
+			setBackendHealth(b, false)
+		}
+		flips, rawFlips := 0, 0
+		for i, ok := range noisy {
+			healthy := applyHealthScore(b, cfg, ok)
+			if healthy != b.IsHealthy {
+				flips++
+			}
+			if i > 0 && ok != noisy[i-1] {
+				rawFlips++
+			}
+			setBackendHealth(b, healthy)
+		}
+		if flips != 0 {
+			t.Fatalf("starting healthy=%v, EWMA flipped %d times on noise the raw results flipped %d times on", start, flips, rawFlips)
+		}
+	}
+
+	b := NewBackend(&Backend{Address: "a:1"})
+	probes := 0
+	for healthy := true; healthy; probes++ {
+		if probes == 10 {
+			t.Fatal("backend still healthy after 10 failed probes")
+		}
+		healthy = applyHealthScore(b, cfg, false)
+		setBackendHealth(b, healthy)
+	}
+	if probes < 2 {
+		t.Fatalf("backend went down after %d failed probe", probes)
+	}
+	for probes = 0; !b.Routable(); probes++ {
+		if probes == 10 {
+			t.Fatal("backend still down after 10 passing probes")
+		}
+		setBackendHealth(b, applyHealthScore(b, cfg, true))
+	}
+}
+
+// TestHealthCheckPathOverride probes one backend with its own
+// health_check_path and another with the global one.
+func TestHealthCheckPathOverride(t *testing.T) {
+	paths := make(chan string, 2)
+	newHealthServer := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			paths <- r.URL.Path
+		}))
+	}
+	own, global := newHealthServer(), newHealthServer()
+	defer own.Close()
+	defer global.Close()
+
+	cfg := &UserConfig{HealthCheckPath: "/health"}
+	withOverride := NewBackend(&Backend{Address: strings.TrimPrefix(own.URL, "http://"), HealthCheckPath: "/status/ready"})
+	withGlobal := NewBackend(&Backend{Address: strings.TrimPrefix(global.URL, "http://")})
+
+	for _, tt := range []struct {
+		backend *Backend
+		want    string
+	}{
+		{withOverride, "/status/ready"},
+		{withGlobal, "/health"},
+	} {
+		checkBackend(context.Background(), tt.backend, cfg)
+		select {
+		case got := <-paths:
+			if got != tt.want {
+				t.Errorf("%s probed at %s, want %s", tt.backend.Address, got, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not probed over HTTP", tt.backend.Address)
+		}
+	}
+}
+
+// TestWarmupProbesInWaves warms up a fleet with a low concurrency and
+// checks no more probes than that are ever in flight, and that each wave
+// finishes before the next one starts.
+func TestWarmupProbesInWaves(t *testing.T) {
+	const (
+		n    = 12
+		wave = 3
+	)
+	var inflight, peak atomic.Int32
+	var mu sync.Mutex
+	var starts []int32
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			old := peak.Load()
+			if now <= old || peak.CompareAndSwap(old, now) {
+				break
+			}
+		}
+		mu.Lock()
+		starts = append(starts, now)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}))
+	defer health.Close()
+	// a fresh connection per probe, so the server sees each one
+	health.Config.SetKeepAlivesEnabled(false)
+
+	addr := strings.TrimPrefix(health.URL, "http://")
+	backends := make([]*Backend, n)
+	for i := range backends {
+		backends[i] = NewBackend(&Backend{Address: addr})
+		setBackendHealth(backends[i], false)
+	}
+	lb := &LoadBalancer{}
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", HealthCheckPath: "/health", WarmupConcurrency: wave}, backends)
+
+	Warmup(context.Background(), lb)
+
+	if got := peak.Load(); got != wave {
+		t.Fatalf("%d probes ran at once, want waves of %d", got, wave)
+	}
+	if len(starts) != n {
+		t.Fatalf("%d probes ran, want %d", len(starts), n)
+	}
+	// every wave starts from an idle fleet
+	for i := 0; i < n; i += wave {
+		if starts[i] != 1 {
+			t.Fatalf("probe %d started with %d probes in flight, want the previous wave finished", i, starts[i]-1)
+		}
+	}
+	for _, b := range backends {
+		if !b.Routable() {
+			t.Fatalf("backend %s not healthy after warmup", b.Address)
+		}
+	}
+}
+
+// TestHealthChecksStopOnCancel cancels the checker while a probe hangs on an
+// unresponsive backend and checks it stops promptly, without waiting for
+// the probe timeout or the rest of the interval.
+func TestHealthChecksStopOnCancel(t *testing.T) {
+	lb := &LoadBalancer{}
+	hung := NewBackend(&Backend{Address: hangingListener(t)})
+	lb.SetPool(&UserConfig{
+		Algorithm:           "round_robin",
+		HealthCheckPath:     "/health",
+		HealthCheckInterval: Duration(time.Minute),
+		Timeout:             Duration(time.Minute),
+	}, []*Backend{hung})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := StartHealthChecks(ctx, lb)
+	// let the first probe get stuck on the hung backend
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("health checks still running a second after cancel")
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("health checks took %s to stop", elapsed)
+	}
+	if !hung.Routable() {
+		t.Fatal("probe cut short by cancel marked the backend down")
+	}
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"sort"
+	"sync"
+)
+
+// SelectionHook lets embedding code override backend selection, e.g. to
+// bucket clients for A/B experiments. It returns the index into backends of
+// the backend to use, or -1 to fall through to the configured algorithm.
+// An index pointing at a backend that can't take connections also falls
+// through.
+type SelectionHook func(clientAddress string, backends []*Backend) int
+
+// ClientHashGroupHook is the built-in hook that splits clients across
+// backend groups; see clientHashGroup.
+const ClientHashGroupHook = "client_hash_group"
+
+var (
+	hooksMu        sync.RWMutex
+	selectionHooks = map[string]SelectionHook{
+		ClientHashGroupHook: clientHashGroup,
+	}
+)
+
+// RegisterSelectionHook makes hook available under name for the
+// selection_hook config option. Registering a name twice replaces the hook.
+func RegisterSelectionHook(name string, hook SelectionHook) {
+	hooksMu.Lock()
+	defer hooksMu.Unlock()
+	selectionHooks[name] = hook
+}
+
+// HasSelectionHook reports whether a hook is registered under name.
+func HasSelectionHook(name string) bool {
+	return lookupSelectionHook(name) != nil
+}
+
+func lookupSelectionHook(name string) SelectionHook {
+	if name == "" {
+		return nil
+	}
+	hooksMu.RLock()
+	defer hooksMu.RUnlock()
+	return selectionHooks[name]
+}
+
+// clientHashGroup buckets clients by a hash of their IP into the distinct
+// groups of the backends, taken in name order, so each group gets an equal
+// share of clients and a client always lands in the same one. Within its
+// group a client sticks to one backend the way ip_hash does. Backends
+// without a group take no part. A client whose group has no routable
+// backend falls through to the algorithm.
+func clientHashGroup(clientAddress string, backends []*Backend) int {
+	var groups []string
+	seen := make(map[string]bool)
+	for _, b := range backends {
+		if b.Group != "" && !seen[b.Group] {
+			seen[b.Group] = true
+			groups = append(groups, b.Group)
+		}
+	}
+	if len(groups) == 0 {
+		return -1
+	}
+	sort.Strings(groups)
+
+	hash := clientHash(clientAddress)
+	group := groups[hash%uint32(len(groups))]
+	var members []int
+	for i, b := range backends {
+		if b.Group == group {
+			members = append(members, i)
+		}
+	}
+	start := int((hash / uint32(len(groups))) % uint32(len(members)))
+	for attempts := 0; attempts < len(members); attempts++ {
+		i := members[(start+attempts)%len(members)]
+		if backends[i].Routable() {
+			return i
+		}
+	}
+	return -1
+}
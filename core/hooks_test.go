@@ -0,0 +1,82 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSelectionHookEvenOdd(t *testing.T) {
+	RegisterSelectionHook("test_even_odd", func(clientAddress string, backends []*Backend) int {
+		return int(clientHash(clientAddress) % 2)
+	})
+	lb := &LoadBalancer{}
+	backends := []*Backend{NewBackend(&Backend{Address: "even:1"}), NewBackend(&Backend{Address: "odd:1"})}
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", SelectionHook: "test_even_odd"}, backends)
+
+	for i := 0; i < 100; i++ {
+		client := fmt.Sprintf("10.0.0.%d:1234", i)
+		b, _, release := lb.GetNextBackend(client, "/")
+		release()
+		if want := backends[clientHash(client)%2]; b != want {
+			t.Fatalf("client %s went to %s, want %s", client, b.Address, want.Address)
+		}
+	}
+
+	// a hook pointing at a backend that can't take connections falls
+	// through to the algorithm
+	setBackendHealth(backends[0], false)
+	for i := 0; i < 100; i++ {
+		b, _, release := lb.GetNextBackend(fmt.Sprintf("10.0.0.%d:1234", i), "/")
+		release()
+		if b != backends[1] {
+			t.Fatalf("selection with the even backend down went to %v", b)
+		}
+	}
+}
+
+func TestClientHashGroupHook(t *testing.T) {
+	lb := &LoadBalancer{}
+	a1 := NewBackend(&Backend{Address: "a1:1", Group: "a"})
+	a2 := NewBackend(&Backend{Address: "a2:1", Group: "a"})
+	b1 := NewBackend(&Backend{Address: "b1:1", Group: "b"})
+	other := NewBackend(&Backend{Address: "other:1"})
+	// group order comes from the names, not the backend order
+	backends := []*Backend{b1, other, a2, a1}
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", SelectionHook: ClientHashGroupHook}, backends)
+
+	perGroup := map[string]int{}
+	for i := 0; i < 200; i++ {
+		client := fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+		wantGroup := []string{"a", "b"}[clientHash(client)%2]
+
+		first, _, release := lb.GetNextBackend(client, "/")
+		release()
+		if first.Group != wantGroup {
+			t.Fatalf("client %s went to %s in group %q, want group %q", client, first.Address, first.Group, wantGroup)
+		}
+		perGroup[first.Group]++
+
+		again, _, release := lb.GetNextBackend(client, "/")
+		release()
+		if again != first {
+			t.Fatalf("client %s moved from %s to %s", client, first.Address, again.Address)
+		}
+	}
+	if perGroup["a"] < 60 || perGroup["b"] < 60 {
+		t.Fatalf("clients per group %v, want an even split", perGroup)
+	}
+
+	// with its group down, a client is left to the algorithm
+	setBackendHealth(b1, false)
+	for i := 0; i < 20; i++ {
+		b, _, release := lb.GetNextBackend(fmt.Sprintf("10.1.0.%d:1234", i), "/")
+		release()
+		if b == nil || b == b1 {
+			t.Fatalf("selection with group b down went to %v", b)
+		}
+	}
+
+	if got := clientHashGroup("10.0.0.1:1", []*Backend{other}); got != -1 {
+		t.Fatalf("hook picked %d from backends without groups, want -1", got)
+	}
+}
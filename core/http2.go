@@ -0,0 +1,79 @@
+package core
+
+import "bytes"
+
+const (
+	http2FrameHeaderLen   = 9
+	http2FrameTypeHeaders = 0x1
+)
+
+var http2Preface = []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+
+// HTTP2RequestCounter watches the client side of a cleartext HTTP/2
+// connection and calls onRequest for every HEADERS frame that opens a new
+// stream, i.e. once per request. Streams that don't start with the HTTP/2
+// connection preface are ignored. It is meant to be used as
+// ProxyOptions.ClientObserver and never fails.
+type HTTP2RequestCounter struct {
+	onRequest func()
+
+	prefaceSeen int
+	notHTTP2    bool
+
+	header    [http2FrameHeaderLen]byte
+	headerLen int
+	skip      int
+
+	lastStream uint32
+}
+
+func NewHTTP2RequestCounter(onRequest func()) *HTTP2RequestCounter {
+	return &HTTP2RequestCounter{onRequest: onRequest}
+}
+
+func (c *HTTP2RequestCounter) Write(p []byte) (int, error) {
+	n := len(p)
+	if c.notHTTP2 {
+		return n, nil
+	}
+
+	if c.prefaceSeen < len(http2Preface) {
+		want := http2Preface[c.prefaceSeen:]
+		m := min(len(want), len(p))
+		if !bytes.Equal(p[:m], want[:m]) {
+			c.notHTTP2 = true
+			return n, nil
+		}
+		c.prefaceSeen += m
+		p = p[m:]
+	}
+
+	for len(p) > 0 {
+		if c.skip > 0 {
+			m := min(c.skip, len(p))
+			c.skip -= m
+			p = p[m:]
+			continue
+		}
+
+		m := copy(c.header[c.headerLen:], p)
+		c.headerLen += m
+		p = p[m:]
+		if c.headerLen < http2FrameHeaderLen {
+			break
+		}
+		c.headerLen = 0
+
+		length := int(c.header[0])<<16 | int(c.header[1])<<8 | int(c.header[2])
+		frameType := c.header[3]
+		stream := (uint32(c.header[5])<<24 | uint32(c.header[6])<<16 | uint32(c.header[7])<<8 | uint32(c.header[8])) & 0x7fffffff
+
+		// CONTINUATION frames and trailers reuse an existing stream id
+		if frameType == http2FrameTypeHeaders && stream > c.lastStream {
+			c.lastStream = stream
+			c.onRequest()
+		}
+		c.skip = length
+	}
+	return n, nil
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func http2Frame(frameType, flags byte, stream uint32, payload []byte) []byte {
+	n := len(payload)
+	frame := []byte{byte(n >> 16), byte(n >> 8), byte(n), frameType, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}
+	return append(frame, payload...)
+}
+
+// TestHTTP2RequestsCountedThroughProxy sends several HTTP/2 requests over
+// one proxied connection and checks each one is counted once, however the
+// frames are split across reads.
+func TestHTTP2RequestsCountedThroughProxy(t *testing.T) {
+	const (
+		data         = 0x0
+		headers      = 0x1
+		settings     = 0x4
+		continuation = 0x9
+	)
+	var stream bytes.Buffer
+	stream.Write(http2Preface)
+	stream.Write(http2Frame(settings, 0, 0, nil))
+	stream.Write(http2Frame(headers, 0x4, 1, []byte("request 1")))
+	stream.Write(http2Frame(data, 0, 1, bytes.Repeat([]byte("x"), 40000)))
+	stream.Write(http2Frame(headers, 0, 3, []byte("request 2")))
+	stream.Write(http2Frame(continuation, 0x4, 3, []byte("more headers")))
+	// trailers on stream 1 are not a new request
+	stream.Write(http2Frame(headers, 0x5, 1, []byte("trailers")))
+	stream.Write(http2Frame(headers, 0x5, 5, []byte("request 3")))
+	want := stream.Bytes()
+
+	clientSide, client := tcpPair(t)
+	backendSide, backend := tcpPair(t)
+	var requests atomic.Int32
+	opts := ProxyOptions{
+		BufPool:        &sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }},
+		ClientObserver: NewHTTP2RequestCounter(func() { requests.Add(1) }),
+	}
+	proxied := make(chan CloseReason, 1)
+	go func() { proxied <- Proxy(clientSide, backendSide, opts) }()
+
+	go func() {
+		for rest := want; len(rest) > 0; {
+			// odd-sized writes split frame headers across reads
+			n := min(7, len(rest))
+			client.Write(rest[:n])
+			rest = rest[n:]
+		}
+	}()
+	backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(backend, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("backend received different bytes than the client sent")
+	}
+	if n := requests.Load(); n != 3 {
+		t.Fatalf("counted %d requests, want 3", n)
+	}
+
+	client.Close()
+	backend.Close()
+	<-proxied
+}
+
+func TestHTTP2RequestCounterIgnoresOtherProtocols(t *testing.T) {
+	var requests int
+	counter := NewHTTP2RequestCounter(func() { requests++ })
+	counter.Write([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"))
+	counter.Write(http2Frame(0x1, 0x4, 1, nil))
+	if requests != 0 {
+		t.Fatalf("counted %d requests on an HTTP/1.1 connection", requests)
+	}
+}
@@ -0,0 +1,348 @@
+package core
+
+import (
+	"Akash/logging"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	maxWriteRetries   = 3
+	writeRetryBackoff = 5 * time.Millisecond
+)
+
+// CloseReason describes why a proxied connection ended.
+type CloseReason string
+
+const (
+	CloseClientClosed    CloseReason = "client_close"
+	CloseBackendClosed   CloseReason = "backend_close"
+	CloseClientError     CloseReason = "client_error"
+	CloseBackendError    CloseReason = "backend_error"
+	CloseIdleTimeout     CloseReason = "idle_timeout"
+	CloseShutdown        CloseReason = "shutdown"
+	CloseRejected        CloseReason = "rejected"
+	CloseDialFailed      CloseReason = "dial_failed"
+	CloseMaxLifetime     CloseReason = "max_lifetime"
+	CloseHandshakeFailed CloseReason = "tls_handshake"
+)
+
+// writeError marks an error that happened writing to the destination of a
+// pipe, as opposed to reading from its source.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string { return e.err.Error() }
+func (e *writeError) Unwrap() error { return e.err }
+
+// ProxyOptions controls how Proxy moves data.
+type ProxyOptions struct {
+	// BufPool supplies the copy buffers and must hold []byte values.
+	BufPool *sync.Pool
+	// Buffers, if set, is used instead of BufPool and sizes each direction's
+	// buffer to the traffic it sees.
+	Buffers *TieredPool
+	// ClientObserver, if set, is handed every chunk read from the client
+	// before it is forwarded. Its errors are ignored.
+	ClientObserver io.Writer
+	// MaxLifetime, if positive, closes the connection once it is this old so
+	// the client reconnects and is balanced again.
+	MaxLifetime time.Duration
+	// IdleTimeout, if positive, closes the connection once no data has
+	// moved in either direction for this long.
+	IdleTimeout time.Duration
+	// CloseTimeout is how long GracefulClose drains the client when Proxy
+	// itself cuts the connection.
+	CloseTimeout time.Duration
+	// Stop, if set, cuts the connection when closed, the same way
+	// MaxLifetime does.
+	Stop <-chan struct{}
+	// Stats, if set, receives the number of bytes copied in each direction.
+	Stats *ProxyStats
+}
+
+// ProxyStats counts the bytes Proxy copied for one connection.
+type ProxyStats struct {
+	FromClient  atomic.Int64
+	FromBackend atomic.Int64
+}
+
+// Proxy copies data in both directions between client and backend until
+// both sides are done and returns why the connection ended, judged by the
+// direction that finished first.
+func Proxy(client, backend net.Conn, opts ProxyOptions) CloseReason {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	reasons := make(chan CloseReason, 2)
+
+	idle := newIdleTracker(opts.IdleTimeout)
+
+	// cutting the connection stops both pipes before the client is
+	// drained, so the drain is the only reader left on the client and no
+	// idle deadline replaces its own
+	var cut atomic.Bool
+	var cutOnce sync.Once
+	stopPipes := func() {
+		cutOnce.Do(func() {
+			cut.Store(true)
+			backend.Close()
+			client.SetReadDeadline(time.Unix(1, 0))
+		})
+	}
+
+	copyFunc := func(dst, src net.Conn, fromClient bool, observer io.Writer) {
+		defer wg.Done()
+		p := &halfPipe{
+			dst: dst,
+			src: src,
+			// only writes towards the client are retried; a backend that
+			// can't accept data is treated as failed straight away
+			retryWrites: !fromClient,
+			observer:    observer,
+			idle:        idle,
+			stopped:     &cut,
+			buffers:     opts.Buffers,
+		}
+		if p.buffers != nil {
+			p.buf = p.buffers.get(0)
+			defer func() { p.buffers.put(p.tier, p.buf) }()
+		} else {
+			p.buf = opts.BufPool.Get().([]byte)
+			defer opts.BufPool.Put(p.buf)
+		}
+		n, err := p.run()
+		if opts.Stats != nil {
+			if fromClient {
+				opts.Stats.FromClient.Add(n)
+			} else {
+				opts.Stats.FromBackend.Add(n)
+			}
+		}
+		reasons <- classifyClose(fromClient, err)
+		logging.Debugf("%s -> %s copy finished: %d bytes, err=%v", src.RemoteAddr(), dst.RemoteAddr(), n, err)
+		closeWrite(dst)
+		// shutting down the read side would make the drain below miss
+		// what the client still sends, and closing on it sends an RST
+		if cr, ok := src.(interface{ CloseRead() error }); ok && !cut.Load() {
+			cr.CloseRead()
+		}
+	}
+
+	var expired atomic.Bool
+	if opts.MaxLifetime > 0 {
+		timer := time.AfterFunc(opts.MaxLifetime, func() {
+			expired.Store(true)
+			logging.Infof("Connection %s reached max lifetime %s, closing", client.RemoteAddr(), opts.MaxLifetime)
+			stopPipes()
+		})
+		defer timer.Stop()
+	}
+	if opts.Stop != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-opts.Stop:
+				stopPipes()
+			case <-finished:
+			}
+		}()
+	}
+
+	go copyFunc(backend, client, true, opts.ClientObserver)
+	go copyFunc(client, backend, false, nil)
+
+	wg.Wait()
+	if cut.Load() {
+		GracefulClose(client, opts.CloseTimeout)
+	}
+	if expired.Load() {
+		return CloseMaxLifetime
+	}
+	return <-reasons
+}
+
+// classifyClose maps the result of one pipe direction to a close reason.
+func classifyClose(fromClient bool, err error) CloseReason {
+	if err == nil {
+		if fromClient {
+			return CloseClientClosed
+		}
+		return CloseBackendClosed
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return CloseIdleTimeout
+	}
+
+	// a failed write lands on the opposite side from a failed read
+	var werr *writeError
+	clientSide := fromClient != errors.As(err, &werr)
+	if clientSide {
+		return CloseClientError
+	}
+	return CloseBackendError
+}
+
+// halfPipe copies one direction of a proxied connection.
+type halfPipe struct {
+	dst, src    net.Conn
+	retryWrites bool
+	// observer, if set, sees each chunk read from src before it is written
+	observer io.Writer
+	// idle, if set, enforces a sliding idle timeout shared by both directions
+	idle *idleTracker
+	// stopped, once set, ends the pipe at its next read
+	stopped *atomic.Bool
+
+	buf []byte
+	// buffers, if set, is the tiered pool buf came from; tier is its index
+	buffers   *TieredPool
+	tier      int
+	fullReads int
+}
+
+// run copies from src to dst until src is exhausted or an error occurs.
+// A read returning io.EOF is a normal end of stream and is not reported.
+func (p *halfPipe) run() (int64, error) {
+	var written int64
+	for {
+		p.idle.armRead(p.src)
+		if p.stopped != nil && p.stopped.Load() {
+			return written, nil
+		}
+		nr, rerr := p.src.Read(p.buf)
+		if nr > 0 {
+			p.idle.touch()
+			if p.observer != nil {
+				p.observer.Write(p.buf[:nr])
+			}
+			p.idle.armWrite(p.dst)
+			nw, werr := writeAll(p.dst, p.buf[:nr], p.retryWrites)
+			written += int64(nw)
+			if werr != nil {
+				return written, &writeError{werr}
+			}
+			p.idle.touch()
+			p.observeRead(nr)
+		}
+		if rerr != nil {
+			if rerr == io.EOF {
+				return written, nil
+			}
+			// a read deadline can expire while the other direction is
+			// still busy; only an idle connection as a whole times out
+			var nerr net.Error
+			if errors.As(rerr, &nerr) && nerr.Timeout() && !p.idle.expired() {
+				continue
+			}
+			return written, rerr
+		}
+	}
+}
+
+// observeRead moves the pipe to a larger buffer once reads keep filling
+// the current one. Buffers only grow: a connection that has shown bulk
+// traffic is likely to again.
+func (p *halfPipe) observeRead(n int) {
+	if p.buffers == nil || p.tier == len(bufferTiers)-1 {
+		return
+	}
+	if n < len(p.buf) {
+		p.fullReads = 0
+		return
+	}
+	p.fullReads++
+	if p.fullReads < growAfterFullReads {
+		return
+	}
+	p.buffers.put(p.tier, p.buf)
+	p.tier++
+	p.buf = p.buffers.get(p.tier)
+	p.fullReads = 0
+}
+
+// idleTracker implements a sliding idle timeout: deadlines are pushed out
+// after every transfer, so a connection that keeps moving data in either
+// direction stays open while one idle in both directions times out. A nil
+// tracker disables the timeout.
+type idleTracker struct {
+	timeout time.Duration
+	last    atomic.Int64
+}
+
+func newIdleTracker(timeout time.Duration) *idleTracker {
+	if timeout <= 0 {
+		return nil
+	}
+	t := &idleTracker{timeout: timeout}
+	t.touch()
+	return t
+}
+
+func (t *idleTracker) touch() {
+	if t != nil {
+		t.last.Store(time.Now().UnixNano())
+	}
+}
+
+func (t *idleTracker) expired() bool {
+	return t != nil && time.Since(time.Unix(0, t.last.Load())) >= t.timeout
+}
+
+// armRead and armWrite set the next deadline on conn. A failure (e.g. the
+// conn was already closed) is only logged; the following Read or Write
+// reports the real error.
+func (t *idleTracker) armRead(conn net.Conn) {
+	if t == nil {
+		return
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(t.timeout)); err != nil {
+		logging.Debugf("Failed to set read deadline on %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+func (t *idleTracker) armWrite(conn net.Conn) {
+	if t == nil {
+		return
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(t.timeout)); err != nil {
+		logging.Debugf("Failed to set write deadline on %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// writeAll writes p to dst, retrying transient errors a bounded number of
+// times when retry is set. The runtime poller already absorbs EAGAIN and
+// EINTR for plain TCP conns, so this only matters for net.Conn
+// implementations that pass such errors through.
+func writeAll(dst net.Conn, p []byte, retry bool) (int, error) {
+	var written, attempts int
+	for len(p) > 0 {
+		n, err := dst.Write(p)
+		written += n
+		p = p[n:]
+		if err == nil {
+			continue
+		}
+		if !retry || !isTransientWriteError(err) || attempts >= maxWriteRetries {
+			return written, err
+		}
+		attempts++
+		logging.Warnf("Transient write error to %s, retrying (%d/%d): %v", dst.RemoteAddr(), attempts, maxWriteRetries, err)
+		time.Sleep(time.Duration(attempts) * writeRetryBackoff)
+	}
+	return written, nil
+}
+
+func isTransientWriteError(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.ENOBUFS)
+}
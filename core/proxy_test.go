@@ -0,0 +1,243 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyConn fails its first writes with err. Later writes go to the
+// embedded conn or, without one, are recorded in written.
+type flakyConn struct {
+	net.Conn
+	failures int
+	err      error
+	written  bytes.Buffer
+}
+
+func (c *flakyConn) Write(p []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, c.err
+	}
+	if c.Conn != nil {
+		return c.Conn.Write(p)
+	}
+	return c.written.Write(p)
+}
+
+func (c *flakyConn) RemoteAddr() net.Addr {
+	if c.Conn != nil {
+		return c.Conn.RemoteAddr()
+	}
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func TestWriteAllRetriesTransientErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		err      error
+		retry    bool
+		wantErr  bool
+	}{
+		{"EAGAIN retried", 2, syscall.EAGAIN, true, false},
+		{"EINTR retried", 1, syscall.EINTR, true, false},
+		{"wrapped ENOBUFS retried", 1, &net.OpError{Op: "write", Err: syscall.ENOBUFS}, true, false},
+		{"retries exhausted", maxWriteRetries + 1, syscall.EAGAIN, true, true},
+		{"not retried towards the backend", 1, syscall.EAGAIN, false, true},
+		{"permanent error", 1, syscall.EPIPE, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &flakyConn{failures: tt.failures, err: tt.err}
+			n, err := writeAll(conn, []byte("stream"), tt.retry)
+			if tt.wantErr {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("writeAll error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("writeAll error %v after a transient failure", err)
+			}
+			if n != len("stream") || conn.written.String() != "stream" {
+				t.Fatalf("wrote %d bytes %q, want the whole stream", n, conn.written.String())
+			}
+		})
+	}
+}
+
+// TestProxyContinuesAfterTransientClientWriteError injects a temporary
+// write error towards the client and checks the stream still arrives.
+func TestProxyContinuesAfterTransientClientWriteError(t *testing.T) {
+	clientSide, client := tcpPair(t)
+	backendSide, backend := tcpPair(t)
+	flaky := &flakyConn{Conn: clientSide, failures: 1, err: syscall.EAGAIN}
+
+	opts := ProxyOptions{BufPool: &sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}}
+	proxied := make(chan CloseReason, 1)
+	go func() { proxied <- Proxy(flaky, backendSide, opts) }()
+
+	want := "first chunk, second chunk"
+	if _, err := backend.Write([]byte(want)); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(client, got); err != nil {
+		t.Fatalf("client read failed after a transient write error: %v", err)
+	}
+	if string(got) != want {
+		t.Fatalf("client read %q, want %q", got, want)
+	}
+
+	client.Close()
+	backend.Close()
+	select {
+	case <-proxied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Proxy did not return")
+	}
+}
+
+// closeInOrder closes first and, once Proxy has seen it, the other side.
+func closeInOrder(first, second net.Conn) {
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	second.Close()
+}
+
+// TestProxyCloseReason ends proxied connections in different ways and checks
+// the reason Proxy reports, which labels akash_connections_closed_total.
+func TestProxyCloseReason(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  ProxyOptions
+		end   func(client, backend net.Conn)
+		label string
+	}{
+		{"idle timeout", ProxyOptions{IdleTimeout: 100 * time.Millisecond}, func(client, backend net.Conn) {}, "idle_timeout"},
+		{"client close", ProxyOptions{}, func(client, backend net.Conn) { closeInOrder(client, backend) }, "client_close"},
+		{"backend close", ProxyOptions{}, func(client, backend net.Conn) { closeInOrder(backend, client) }, "backend_close"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSide, client := tcpPair(t)
+			backendSide, backend := tcpPair(t)
+			defer client.Close()
+			defer backend.Close()
+
+			tt.opts.BufPool = &sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}
+			proxied := make(chan CloseReason, 1)
+			go func() { proxied <- Proxy(clientSide, backendSide, tt.opts) }()
+
+			// traffic first, so an idle timeout has to come from silence
+			if _, err := client.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(backend, make([]byte, 4)); err != nil {
+				t.Fatal(err)
+			}
+			tt.end(client, backend)
+
+			select {
+			case reason := <-proxied:
+				if string(reason) != tt.label {
+					t.Fatalf("close reason %q, want %q", reason, tt.label)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Proxy did not return")
+			}
+		})
+	}
+}
+
+// TestMaxLifetimeForcesReselection checks that a connection older than
+// conn_max_lifetime is closed, and that the reconnecting client is
+// balanced onto the next backend.
+func TestMaxLifetimeForcesReselection(t *testing.T) {
+	lb := &LoadBalancer{}
+	newTestPool(lb, "round_robin", "a:1", "b:1")
+	first, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+
+	clientSide, client := tcpPair(t)
+	backendSide, backend := tcpPair(t)
+	defer client.Close()
+	defer backend.Close()
+	opts := ProxyOptions{
+		BufPool:     &sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }},
+		MaxLifetime: 100 * time.Millisecond,
+	}
+	start := time.Now()
+	proxied := make(chan CloseReason, 1)
+	go func() { proxied <- Proxy(clientSide, backendSide, opts) }()
+
+	select {
+	case reason := <-proxied:
+		if reason != CloseMaxLifetime {
+			t.Fatalf("close reason %q, want %q", reason, CloseMaxLifetime)
+		}
+		if elapsed := time.Since(start); elapsed < opts.MaxLifetime {
+			t.Fatalf("connection closed after %s, before its max lifetime", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection outlived its max lifetime")
+	}
+	release()
+
+	next, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+	release()
+	if next == first {
+		t.Fatalf("reconnect went back to %s, want the next backend", first.Address)
+	}
+}
+
+// TestIdleTimeoutSlidesWithTraffic keeps data flowing well past the idle
+// timeout and checks the connection stays up, since every chunk pushes the
+// deadline out again.
+func TestIdleTimeoutSlidesWithTraffic(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	clientSide, client := tcpPair(t)
+	backendSide, backend := tcpPair(t)
+	defer client.Close()
+	defer backend.Close()
+	opts := ProxyOptions{
+		BufPool:     &sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }},
+		IdleTimeout: idle,
+	}
+	proxied := make(chan CloseReason, 1)
+	go func() { proxied <- Proxy(clientSide, backendSide, opts) }()
+
+	chunk := make([]byte, 4)
+	for start := time.Now(); time.Since(start) < 5*idle; {
+		if _, err := client.Write([]byte("tick")); err != nil {
+			t.Fatalf("client write after %s: %v", time.Since(start), err)
+		}
+		backend.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := io.ReadFull(backend, chunk); err != nil {
+			t.Fatalf("backend read after %s: %v", time.Since(start), err)
+		}
+		select {
+		case reason := <-proxied:
+			t.Fatalf("active connection closed after %s with reason %q", time.Since(start), reason)
+		case <-time.After(idle / 3):
+		}
+	}
+
+	// once the traffic stops the connection does time out
+	select {
+	case reason := <-proxied:
+		if reason != CloseIdleTimeout {
+			t.Fatalf("close reason %q, want %q", reason, CloseIdleTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection was not closed")
+	}
+}
@@ -0,0 +1,269 @@
+package core
+
+import (
+	"Akash/logging"
+	"Akash/metrics"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxReplayBytes caps how much client data a ReconnectingConn keeps for
+// replay. A client that sends more before the backend answers is not
+// reconnected.
+const maxReplayBytes = 64 << 10
+
+// defaultMaxRetries is used when reconnect_on_backend_drop is set without
+// max_retries.
+const defaultMaxRetries = 1
+
+var errNoReconnect = errors.New("backend connection can't be reconnected")
+
+// ReconnectingConn is a backend connection that moves to another backend
+// when the current one drops the connection before sending anything back.
+// Until the first byte arrives from the backend, everything the client
+// wrote is kept and replayed to the new backend, so the client never sees
+// the drop. Once the backend has answered, or the client has sent more
+// than maxReplayBytes, it behaves like the plain connection.
+type ReconnectingConn struct {
+	lb         *LoadBalancer
+	clientAddr string
+
+	// settled is set once reconnecting is no longer possible
+	settled atomic.Bool
+
+	mu          sync.Mutex
+	conn        net.Conn
+	backend     *Backend
+	release     func()
+	replay      []byte
+	retries     int
+	writeClosed bool
+	closed      bool
+	// reconnecting is closed once a reconnect in progress has finished
+	reconnecting chan struct{}
+}
+
+// NewReconnectingConn wraps conn, which was dialed to backend for the client
+// at clientAddr. The connection takes over release, which must no longer be
+// called directly; call Release instead.
+func (lb *LoadBalancer) NewReconnectingConn(conn net.Conn, backend *Backend, release func(), clientAddr string) *ReconnectingConn {
+	retries := lb.Config().MaxRetries
+	if retries <= 0 {
+		retries = defaultMaxRetries
+	}
+	return &ReconnectingConn{
+		lb:         lb,
+		clientAddr: clientAddr,
+		conn:       conn,
+		backend:    backend,
+		release:    release,
+		retries:    retries,
+	}
+}
+
+func (c *ReconnectingConn) current() net.Conn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// Backend returns the backend the connection currently goes to.
+func (c *ReconnectingConn) Backend() *Backend {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.backend
+}
+
+// Release releases the current backend selection.
+func (c *ReconnectingConn) Release() {
+	c.mu.Lock()
+	release := c.release
+	c.mu.Unlock()
+	release()
+}
+
+func (c *ReconnectingConn) settle() {
+	if c.settled.Swap(true) {
+		return
+	}
+	c.mu.Lock()
+	c.replay = nil
+	c.mu.Unlock()
+}
+
+func (c *ReconnectingConn) Read(p []byte) (int, error) {
+	for {
+		conn := c.current()
+		n, err := conn.Read(p)
+		if n > 0 {
+			c.settle()
+			return n, err
+		}
+		if err == nil || !c.retryable(err) {
+			return n, err
+		}
+		if rerr := c.reconnect(conn); rerr != nil {
+			return n, err
+		}
+	}
+}
+
+func (c *ReconnectingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	conn := c.conn
+	buffered := false
+	if !c.settled.Load() {
+		if len(c.replay)+len(p) <= maxReplayBytes {
+			c.replay = append(c.replay, p...)
+			buffered = true
+		} else {
+			c.settled.Store(true)
+			c.replay = nil
+		}
+	}
+	c.mu.Unlock()
+
+	n, err := conn.Write(p)
+	if err == nil || !buffered || !c.retryable(err) {
+		return n, err
+	}
+	// p is in the replay buffer, so it reaches the next backend
+	if rerr := c.reconnect(conn); rerr != nil {
+		return n, err
+	}
+	return len(p), nil
+}
+
+// retryable reports whether err from the current backend may be answered
+// by reconnecting. Deadlines belong to the proxy and are never retried.
+func (c *ReconnectingConn) retryable(err error) bool {
+	if c.settled.Load() {
+		return false
+	}
+	var nerr net.Error
+	return !(errors.As(err, &nerr) && nerr.Timeout())
+}
+
+// reconnect replaces failed with a connection to another backend and
+// replays the buffered client data to it. It does nothing if failed has
+// already been replaced. The dial runs without c.mu held, so closing the
+// connection is never held up by it; a reconnect that races a close or a
+// second failure of the same connection waits for the first instead.
+func (c *ReconnectingConn) reconnect(failed net.Conn) error {
+	c.mu.Lock()
+	for c.reconnecting != nil {
+		wait := c.reconnecting
+		c.mu.Unlock()
+		<-wait
+		c.mu.Lock()
+	}
+	if c.conn != failed {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.closed || c.settled.Load() || c.retries <= 0 {
+		c.mu.Unlock()
+		return errNoReconnect
+	}
+	c.retries--
+	dropped := c.backend
+	done := make(chan struct{})
+	c.reconnecting = done
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		c.reconnecting = nil
+		c.mu.Unlock()
+		close(done)
+	}()
+
+	metrics.PerBackendFails.WithLabelValues(dropped.Address).Inc()
+
+	conn, backend, release, err := c.lb.dialBackend(c.clientAddr, "/", dropped)
+	if err != nil {
+		logging.Limited.Warnf("Backend %s dropped a connection before responding and reconnecting failed: %v", dropped.Address, err)
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the client may have been closed, or sent too much to replay, while
+	// the new backend was being dialed
+	if c.closed || c.settled.Load() {
+		conn.Close()
+		release()
+		return errNoReconnect
+	}
+	if len(c.replay) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(c.lb.Config().backendDialTimeout()))
+		_, err := conn.Write(c.replay)
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			release()
+			logging.Warnf("Backend %s dropped %s before responding and replaying to %s failed: %v", dropped.Address, c.clientAddr, backend.Address, err)
+			return err
+		}
+	}
+	if c.writeClosed {
+		closeWrite(conn)
+	}
+
+	failed.Close()
+	c.release()
+	c.conn, c.backend, c.release = conn, backend, release
+	logging.Infof("Backend %s dropped %s before responding, reconnected to %s", dropped.Address, c.clientAddr, backend.Address)
+	return nil
+}
+
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *ReconnectingConn) CloseWrite() error {
+	c.mu.Lock()
+	c.writeClosed = true
+	conn := c.conn
+	c.mu.Unlock()
+	return closeWrite(conn)
+}
+
+func (c *ReconnectingConn) CloseRead() error {
+	c.settle()
+	if cr, ok := c.current().(interface{ CloseRead() error }); ok {
+		return cr.CloseRead()
+	}
+	return nil
+}
+
+func (c *ReconnectingConn) Close() error {
+	c.settle()
+	c.mu.Lock()
+	c.closed = true
+	conn := c.conn
+	c.mu.Unlock()
+	return conn.Close()
+}
+
+func (c *ReconnectingConn) LocalAddr() net.Addr  { return c.current().LocalAddr() }
+func (c *ReconnectingConn) RemoteAddr() net.Addr { return c.current().RemoteAddr() }
+
+func (c *ReconnectingConn) SetDeadline(t time.Time) error {
+	return c.current().SetDeadline(t)
+}
+
+func (c *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	return c.current().SetReadDeadline(t)
+}
+
+func (c *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	return c.current().SetWriteDeadline(t)
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve runs handle for every connection accepted on a new loopback
+// listener and returns its address.
+func serve(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dropper closes every connection without answering.
+func dropper(conn net.Conn) { conn.Close() }
+
+// responder answers the first read with "ok " and what it read.
+func responder(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return
+	}
+	conn.Write(append([]byte("ok "), buf[:n]...))
+}
+
+// clientFor returns a client address that selection sends to want.
+func clientFor(t *testing.T, lb *LoadBalancer, want *Backend) string {
+	t.Helper()
+	for i := 0; i < 256; i++ {
+		client := fmt.Sprintf("10.0.0.%d:1234", i)
+		b, _, release := lb.GetNextBackend(client, "/")
+		release()
+		if b == want {
+			return client
+		}
+	}
+	t.Fatalf("no client address is routed to %s", want.Address)
+	return ""
+}
+
+// TestReconnectSkipsDroppedBackend checks that a client pinned to a backend
+// by ip_hash is moved to another backend when its own drops it, rather than
+// being sent straight back.
+func TestReconnectSkipsDroppedBackend(t *testing.T) {
+	lb := &LoadBalancer{}
+	dropping := NewBackend(&Backend{Address: serve(t, dropper)})
+	good := NewBackend(&Backend{Address: serve(t, responder)})
+	lb.SetPool(&UserConfig{Algorithm: "ip_hash", MaxRetries: 1}, []*Backend{dropping, good})
+	client := clientFor(t, lb, dropping)
+
+	conn, backend, release, err := lb.DialBackend(client, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := lb.NewReconnectingConn(conn, backend, release, client)
+	defer rc.Close()
+	defer rc.Release()
+
+	if _, err := rc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	rc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ok hello" {
+		t.Fatalf("read %q, want %q", got, "ok hello")
+	}
+	if rc.Backend() != good {
+		t.Fatalf("connection ended up on %s, want %s", rc.Backend().Address, good.Address)
+	}
+}
+
+// TestCloseDuringReconnect checks that closing a connection isn't held up
+// by a reconnect dialing a backend that doesn't answer.
+func TestCloseDuringReconnect(t *testing.T) {
+	lb := &LoadBalancer{}
+	dropping := NewBackend(&Backend{Address: serve(t, dropper)})
+	hanging := NewBackend(&Backend{Address: hangingListener(t), TLS: true})
+	lb.SetPool(&UserConfig{Algorithm: "ip_hash", Timeout: Duration(time.Second)}, []*Backend{dropping, hanging})
+	client := clientFor(t, lb, dropping)
+
+	conn, backend, release, err := lb.DialBackend(client, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := lb.NewReconnectingConn(conn, backend, release, client)
+	if _, err := rc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	readDone := make(chan error, 1)
+	go func() {
+		_, err := rc.Read(make([]byte, 64))
+		readDone <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	start := time.Now()
+	rc.Close()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("Close took %s while a reconnect was dialing", elapsed)
+	}
+
+	select {
+	case err := <-readDone:
+		if err == nil {
+			t.Fatal("Read succeeded on a closed connection")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read did not return after Close")
+	}
+	rc.Release()
+	if n := lb.ConnectionCount; n != 0 {
+		t.Fatalf("ConnectionCount = %d after Close and Release, want 0", n)
+	}
+}
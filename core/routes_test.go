@@ -0,0 +1,106 @@
+package core
+
+import (
+	"Akash/metrics"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// routeMatches returns the akash_route_matches_total count for each route.
+func routeMatches(t *testing.T) map[string]float64 {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.RouteMatchesTotal)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]float64{}
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			counts[m.GetLabel()[0].GetValue()] = m.GetCounter().GetValue()
+		}
+	}
+	return counts
+}
+
+// TestRouteMatches sends connections through each kind of route rule and
+// checks the longest matching prefix wins and every rule, the hook and the
+// default fallthrough are counted.
+func TestRouteMatches(t *testing.T) {
+	RegisterSelectionHook("test_route_hook", func(clientAddress string, backends []*Backend) int {
+		if clientAddress == "10.9.9.9:1" {
+			return 2
+		}
+		return -1
+	})
+	lb := &LoadBalancer{}
+	api := NewBackend(&Backend{Address: "api:1", Paths: []string{"/api"}})
+	v2 := NewBackend(&Backend{Address: "v2:1", Paths: []string{"/api/v2"}})
+	hooked := NewBackend(&Backend{Address: "hooked:1"})
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", SelectionHook: "test_route_hook"}, []*Backend{api, v2, hooked})
+
+	before := routeMatches(t)
+	tests := []struct {
+		client, path string
+		want         *Backend
+		route        string
+	}{
+		{"10.0.0.1:1", "/api/users", api, "/api"},
+		{"10.0.0.1:1", "/api/v2/users", v2, "/api/v2"},
+		{"10.0.0.1:1", "/api/v2", v2, "/api/v2"},
+		{"10.9.9.9:1", "/static", hooked, RouteHookPrefix + "test_route_hook"},
+		{"10.0.0.1:1", "/static", nil, RouteDefault},
+		{"10.0.0.1:1", "/", nil, RouteDefault},
+	}
+	want := map[string]float64{}
+	for _, tt := range tests {
+		b, _, release := lb.GetNextBackend(tt.client, tt.path)
+		release()
+		if tt.want != nil && b != tt.want {
+			t.Errorf("%s from %s went to %v, want %s", tt.path, tt.client, b, tt.want.Address)
+		}
+		want[tt.route]++
+	}
+
+	after := routeMatches(t)
+	for route, n := range want {
+		if got := after[route] - before[route]; got != n {
+			t.Errorf("route %q counted %v times, want %v", route, got, n)
+		}
+	}
+}
+
+// TestLongestPrefixWins checks overlapping path prefixes against many fresh
+// route maps, so a result that depended on map iteration order would show.
+func TestLongestPrefixWins(t *testing.T) {
+	prefixes := []string{"/", "/api", "/api/v2", "/api/v2/users", "/apix"}
+	tests := map[string]string{
+		"/":                  "/",
+		"/static/app.js":     "/",
+		"/api":               "/api",
+		"/api/v1/users":      "/api",
+		"/api/v2":            "/api/v2",
+		"/api/v2/orders":     "/api/v2",
+		"/api/v2/users/7":    "/api/v2/users",
+		"/apix/y":            "/apix",
+		"/api/v2/usersearch": "/api/v2/users",
+	}
+	for round := 0; round < 50; round++ {
+		lb := &LoadBalancer{}
+		backends := make([]*Backend, len(prefixes))
+		for i, p := range prefixes {
+			backends[i] = NewBackend(&Backend{Address: "backend" + p + ":1", Paths: []string{p}})
+		}
+		lb.SetPool(&UserConfig{Algorithm: "round_robin"}, backends)
+
+		for path, want := range tests {
+			b, _, release := lb.GetNextBackend("10.0.0.1:1", path)
+			release()
+			if b == nil || b.Paths[0] != want {
+				t.Fatalf("round %d: %s went to %v, want the %s route", round, path, b, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"Akash/logging"
+	"context"
+	"encoding/json"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is the periodic summary written by StartStatsLogger.
+type Stats struct {
+	ActiveConnections int32          `json:"active_connections"`
+	Healthy           int            `json:"healthy"`
+	Total             int            `json:"total"`
+	Served            int64          `json:"served"`
+	Backends          []BackendStats `json:"backends"`
+}
+
+type BackendStats struct {
+	Address           string `json:"address"`
+	Healthy           bool   `json:"healthy"`
+	ActiveConnections int32  `json:"active_connections"`
+	Served            int32  `json:"served"`
+}
+
+// Stats returns aggregate counters for the balancer and each backend.
+func (lb *LoadBalancer) Stats() Stats {
+	backends := lb.Pool().Backends
+
+	stats := Stats{
+		ActiveConnections: atomic.LoadInt32(&lb.ConnectionCount),
+		Total:             len(backends),
+		Backends:          make([]BackendStats, 0, len(backends)),
+	}
+	for _, b := range backends {
+		served := b.served.Load()
+
+		b.mutex.Lock()
+		bs := BackendStats{
+			Address:           b.Address,
+			Healthy:           b.IsHealthy,
+			ActiveConnections: b.ActiveConnections,
+			Served:            served,
+		}
+		b.mutex.Unlock()
+
+		if bs.Healthy {
+			stats.Healthy++
+		}
+		stats.Served += int64(served)
+		stats.Backends = append(stats.Backends, bs)
+	}
+	return stats
+}
+
+// StartStatsLogger logs lb.Stats() every stats_log_interval until ctx is
+// cancelled. It does nothing when the interval is not set.
+func StartStatsLogger(ctx context.Context, lb *LoadBalancer) {
+	interval := lb.Config().StatsLogInterval.Duration()
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			line, err := json.Marshal(lb.Stats())
+			if err != nil {
+				logging.Errorf("Failed to encode stats: %v", err)
+				continue
+			}
+			logging.Infof("event=stats %s", line)
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lineWriter hands every log line containing match to lines.
+type lineWriter struct {
+	match string
+	lines chan string
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	if line := string(p); strings.Contains(line, w.match) {
+		select {
+		case w.lines <- line:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+// captureLog returns the log lines containing match until the test ends.
+func captureLog(t *testing.T, match string) <-chan string {
+	w := &lineWriter{match: match, lines: make(chan string, 100)}
+	log.SetOutput(w)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return w.lines
+}
+
+// TestStatsLoggedAtInterval checks that the stats line is written every
+// stats_log_interval and reports the balancer's current counts.
+func TestStatsLoggedAtInterval(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	lines := captureLog(t, "event=stats ")
+
+	lb := &LoadBalancer{}
+	a, b := NewBackend(&Backend{Address: "a:1"}), NewBackend(&Backend{Address: "b:1"})
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", StatsLogInterval: Duration(interval)}, []*Backend{a, b})
+	// round robin picks b, a, b; a keeps its connection and then goes down
+	for i := 0; i < 3; i++ {
+		if picked, _, release := lb.GetNextBackend("10.0.0.1:1", "/"); picked != a {
+			release()
+		}
+	}
+	setBackendHealth(a, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	start := time.Now()
+	StartStatsLogger(ctx, lb)
+	var at []time.Duration
+	var stats Stats
+	for len(at) < 2 {
+		select {
+		case line := <-lines:
+			at = append(at, time.Since(start))
+			_, payload, _ := strings.Cut(line, "event=stats ")
+			if err := json.Unmarshal([]byte(payload), &stats); err != nil {
+				t.Fatalf("stats line %q is not JSON: %v", line, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no stats line logged")
+		}
+	}
+	for i, d := range at {
+		if want := time.Duration(i+1) * interval; d < want-interval/2 || d > want+interval/2 {
+			t.Errorf("stats line %d logged after %s, want about %s", i, d, want)
+		}
+	}
+
+	want := Stats{
+		ActiveConnections: 1,
+		Healthy:           1,
+		Total:             2,
+		Served:            3,
+		Backends: []BackendStats{
+			{Address: "a:1", Healthy: false, ActiveConnections: 1, Served: 1},
+			{Address: "b:1", Healthy: true, ActiveConnections: 0, Served: 2},
+		},
+	}
+	got, _ := json.Marshal(stats)
+	wantJSON, _ := json.Marshal(want)
+	if string(got) != string(wantJSON) {
+		t.Fatalf("stats %s, want %s", got, wantJSON)
+	}
+}
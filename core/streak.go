@@ -0,0 +1,56 @@
+package core
+
+import (
+	"Akash/logging"
+	"sync"
+	"time"
+)
+
+// streakWarnInterval throttles selection streak warnings.
+const streakWarnInterval = time.Minute
+
+// streakDetector tracks how many consecutive connections the algorithm has
+// sent to the same backend.
+type streakDetector struct {
+	mu       sync.Mutex
+	last     *Backend
+	count    int
+	lastWarn time.Time
+}
+
+// observeSelection records that the algorithm picked b and warns, at most
+// once per streakWarnInterval, when it has picked b for more consecutive
+// connections than selection_streak_warn allows. Under w_round_robin the
+// allowance is multiplied by b's weight, since heavier backends are
+// expected to win several times in a row. Single-backend pools are
+// ignored.
+func (lb *LoadBalancer) observeSelection(pool *Pool, b *Backend) {
+	threshold := pool.Config.SelectionStreakWarn
+	if threshold <= 0 || len(pool.Backends) < 2 {
+		return
+	}
+	if pool.Algo == WeightedRoundRobin {
+		b.mutex.Lock()
+		threshold *= max(b.Weight, 1)
+		b.mutex.Unlock()
+	}
+
+	s := &lb.streak
+	s.mu.Lock()
+	if s.last != b {
+		s.last = b
+		s.count = 0
+	}
+	s.count++
+	count := s.count
+	warn := count > threshold && time.Since(s.lastWarn) >= streakWarnInterval
+	if warn {
+		s.lastWarn = time.Now()
+	}
+	s.mu.Unlock()
+
+	if warn {
+		routable, total := lb.RoutableCount()
+		logging.Warnf("%s picked %s for %d connections in a row (%d/%d backends routable); check health, weights and hashing", pool.Algo, b.Address, count, routable, total)
+	}
+}
@@ -0,0 +1,48 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSelectionStreakWarning sends one client to the same backend over and
+// over and checks a single warning is logged for the whole streak, while
+// rotating selection never warns.
+func TestSelectionStreakWarning(t *testing.T) {
+	warnings := captureLog(t, "in a row")
+
+	lb := &LoadBalancer{}
+	backends := newTestPool(lb, "ip_hash", "a:1", "b:1", "c:1")
+	lb.SetPool(&UserConfig{Algorithm: "ip_hash", SelectionStreakWarn: 10}, backends)
+	for i := 0; i < 500; i++ {
+		_, _, release := lb.GetNextBackend("10.0.0.1:1", "/")
+		release()
+	}
+
+	select {
+	case line := <-warnings:
+		if !strings.Contains(line, "ip_hash picked") || !strings.Contains(line, "for 11 connections in a row (3/3 backends routable)") {
+			t.Fatalf("unexpected warning %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no warning for a streak of 500 connections")
+	}
+	select {
+	case line := <-warnings:
+		t.Fatalf("streak warned more than once: %q", line)
+	default:
+	}
+
+	rotating := &LoadBalancer{}
+	rotating.SetPool(&UserConfig{Algorithm: "round_robin", SelectionStreakWarn: 10}, backends)
+	for i := 0; i < 500; i++ {
+		_, _, release := rotating.GetNextBackend("10.0.0.1:1", "/")
+		release()
+	}
+	select {
+	case line := <-warnings:
+		t.Fatalf("round robin warned: %q", line)
+	default:
+	}
+}
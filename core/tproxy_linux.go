@@ -0,0 +1,44 @@
+//go:build linux
+
+package core
+
+import (
+	"strings"
+	"syscall"
+)
+
+// Transparent proxying makes backend connections originate from the client's
+// own address, so backends see the real client IP as the TCP source.
+//
+// Kernel requirements:
+//   - The process needs CAP_NET_ADMIN (or root) to set IP_TRANSPARENT, which
+//     is what allows binding to a non-local client address.
+//   - Backend replies are addressed to the client, so they must be routed
+//     back through this host and delivered to the local socket, typically:
+//     iptables -t mangle -A PREROUTING -p tcp -m socket -j MARK --set-mark 1
+//     ip rule add fwmark 1 lookup 100
+//     ip route add local 0.0.0.0/0 dev lo table 100
+//   - Akash must sit on the backends' return path (e.g. as their gateway).
+
+// TransparentSupported reports whether transparent mode works on this platform.
+const TransparentSupported = true
+
+// IPV6_TRANSPARENT from linux/in6.h; not exported by package syscall.
+const ipv6Transparent = 0x4b
+
+// transparentControl sets IP_TRANSPARENT (or IPV6_TRANSPARENT) on a socket
+// before it is bound, for use as a net.Dialer Control function.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
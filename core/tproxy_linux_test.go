@@ -0,0 +1,53 @@
+//go:build linux
+
+package core
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// TestTransparentSocketOptions checks that transparent mode binds backend
+// dials to the client address and sets IP_TRANSPARENT on the socket.
+func TestTransparentSocketOptions(t *testing.T) {
+	lb := &LoadBalancer{}
+	lb.SetPool(&UserConfig{Algorithm: "round_robin", Transparent: true}, nil)
+	dialer, err := lb.backendDialer("127.0.0.2:40000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if local, ok := dialer.LocalAddr.(*net.TCPAddr); !ok || !local.IP.Equal(net.IPv4(127, 0, 0, 2)) {
+		t.Fatalf("dialer binds to %v, want the client IP 127.0.0.2", dialer.LocalAddr)
+	}
+
+	// a listening socket goes through the same Control hook without
+	// needing the routing setup a transparent dial does
+	lc := net.ListenConfig{Control: dialer.Control}
+	ln, err := lc.Listen(context.Background(), "tcp4", "127.0.0.1:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting IP_TRANSPARENT needs CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	raw, err := ln.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	raw.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	if value != 1 {
+		t.Fatalf("IP_TRANSPARENT is %d, want 1", value)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package core
+
+import (
+	"errors"
+	"syscall"
+)
+
+// TransparentSupported reports whether transparent mode works on this platform.
+const TransparentSupported = false
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errors.New("transparent proxying is only supported on linux")
+}
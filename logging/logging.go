@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	default:
+		return "ERROR"
+	}
+}
+
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown log level %q", name)
+	}
+}
+
+var (
+	level      atomic.Int32
+	jsonFormat atomic.Bool
+)
+
+func init() {
+	level.Store(int32(LevelInfo))
+}
+
+// Configure sets the log level ("debug", "info", "warn", "error") and format
+// ("text" or "json"). It is safe to call while other goroutines are logging,
+// so it can be applied on config reload.
+func Configure(levelName, format string) error {
+	l, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+
+	var useJSON bool
+	switch strings.ToLower(format) {
+	case "", "text":
+	case "json":
+		useJSON = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	level.Store(int32(l))
+	jsonFormat.Store(useJSON)
+	return nil
+}
+
+// Enabled reports whether messages at l are currently written.
+func Enabled(l Level) bool {
+	return l >= Level(level.Load())
+}
+
+func Debugf(format string, args ...interface{}) { logf(LevelDebug, format, args...) }
+func Infof(format string, args ...interface{})  { logf(LevelInfo, format, args...) }
+func Warnf(format string, args ...interface{})  { logf(LevelWarn, format, args...) }
+func Errorf(format string, args ...interface{}) { logf(LevelError, format, args...) }
+
+// Fatalf logs at error level and exits.
+func Fatalf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+	os.Exit(1)
+}
+
+type jsonLine struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if !jsonFormat.Load() {
+		log.Printf("[%s] %s", l, msg)
+		return
+	}
+
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(jsonLine{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   strings.ToLower(l.String()),
+		Message: msg,
+	})
+	if err != nil {
+		log.Printf("[%s] %s", l, msg)
+		return
+	}
+	log.Writer().Write(line.Bytes())
+}
@@ -0,0 +1,101 @@
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Limiter collapses repeated identical log lines. The first occurrence of a
+// message is written at once; further identical messages within the window
+// are only counted and written as a single summary line when the window
+// ends, so a failure storm produces a few lines per window instead of one
+// per failure.
+type Limiter struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[limitKey]*limitEntry
+	flusher sync.Once
+}
+
+type limitKey struct {
+	level Level
+	msg   string
+}
+
+type limitEntry struct {
+	start      time.Time
+	suppressed int
+}
+
+// Limited is the limiter used on Akash's hot error paths.
+var Limited = NewLimiter(10 * time.Second)
+
+func NewLimiter(window time.Duration) *Limiter {
+	return &Limiter{
+		window:  window,
+		entries: make(map[limitKey]*limitEntry),
+	}
+}
+
+func (r *Limiter) Warnf(format string, args ...interface{}) {
+	r.logf(LevelWarn, format, args...)
+}
+
+func (r *Limiter) Errorf(format string, args ...interface{}) {
+	r.logf(LevelError, format, args...)
+}
+
+func (r *Limiter) logf(l Level, format string, args ...interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	r.flusher.Do(func() { go r.flushLoop() })
+
+	key := limitKey{level: l, msg: fmt.Sprintf(format, args...)}
+	r.mu.Lock()
+	if e, ok := r.entries[key]; ok {
+		e.suppressed++
+		r.mu.Unlock()
+		return
+	}
+	r.entries[key] = &limitEntry{start: time.Now()}
+	r.mu.Unlock()
+
+	logf(l, "%s", key.msg)
+}
+
+// flushLoop writes a summary for every message whose window has ended and
+// forgets it, so its next occurrence is written in full again.
+func (r *Limiter) flushLoop() {
+	ticker := time.NewTicker(r.window / 2)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.flush(now)
+	}
+}
+
+func (r *Limiter) flush(now time.Time) {
+	type summary struct {
+		key   limitKey
+		count int
+	}
+	var summaries []summary
+
+	r.mu.Lock()
+	for key, e := range r.entries {
+		if now.Sub(e.start) < r.window {
+			continue
+		}
+		if e.suppressed > 0 {
+			summaries = append(summaries, summary{key, e.suppressed})
+		}
+		delete(r.entries, key)
+	}
+	r.mu.Unlock()
+
+	for _, s := range summaries {
+		logf(s.key.level, "%s (%d more occurrences in last %s)", s.key.msg, s.count, r.window)
+	}
+}
@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLimiterCollapsesRepeats logs a storm of identical errors and checks it
+// comes out as one line plus one summary per window.
+func TestLimiterCollapsesRepeats(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer log.SetFlags(flags)
+
+	// the window is long enough that only the explicit flushes below end it
+	limiter := NewLimiter(time.Hour)
+	for i := 0; i < 1000; i++ {
+		limiter.Errorf("failed to connect backend %s", "10.0.0.1:80")
+	}
+	limiter.Warnf("failed to connect backend %s", "10.0.0.2:80")
+	limiter.Warnf("failed to connect backend %s", "10.0.0.2:80")
+
+	want := "[ERROR] failed to connect backend 10.0.0.1:80\n" +
+		"[WARN] failed to connect backend 10.0.0.2:80\n"
+	if got := out.String(); got != want {
+		t.Fatalf("log during the storm:\n%s\nwant:\n%s", got, want)
+	}
+
+	out.Reset()
+	limiter.flush(time.Now().Add(time.Hour))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	wantSummaries := map[string]bool{
+		"[ERROR] failed to connect backend 10.0.0.1:80 (999 more occurrences in last 1h0m0s)": true,
+		"[WARN] failed to connect backend 10.0.0.2:80 (1 more occurrences in last 1h0m0s)":    true,
+	}
+	if len(lines) != len(wantSummaries) {
+		t.Fatalf("summaries:\n%s\nwant one per message", out.String())
+	}
+	for _, line := range lines {
+		if !wantSummaries[line] {
+			t.Fatalf("unexpected summary %q", line)
+		}
+	}
+
+	// a new window starts with the message in full again
+	out.Reset()
+	limiter.Errorf("failed to connect backend %s", "10.0.0.1:80")
+	if got := out.String(); got != "[ERROR] failed to connect backend 10.0.0.1:80\n" {
+		t.Fatalf("first error of a new window logged as %q", got)
+	}
+}
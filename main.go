@@ -1,13 +1,18 @@
 package main
 
 import (
+	"Akash/admin"
 	"Akash/config"
 	"Akash/core"
+	"Akash/logging"
 	"Akash/metrics"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"flag"
-	"io"
-	"log"
+	mrand "math/rand"
 	"net"
 	"os"
 	"os/signal"
@@ -15,26 +20,38 @@ import (
 	"sync"
 	"sync/atomic"
 	"syscall"
+	"time"
 )
 
-var currentTLSConfig atomic.Value
-
 func main() {
 	// -------------------- config --------------------
 	configPath := flag.String("config", "", "Path to Config file (JSON)")
+	simulate := flag.Int("simulate", 0, "Route this many simulated clients, print the per-backend distribution and exit")
 	flag.Parse()
 
 	if strings.TrimSpace(*configPath) == "" {
-		log.Fatal("Please provide a Config file using -config flag")
+		logging.Fatalf("Please provide a Config file using -config flag")
 	}
 
 	cfg, err := config.LoadConfig(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to load Config: %v", err)
+		logging.Fatalf("Failed to load Config: %v", err)
+	}
+
+	if err := logging.Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+		logging.Fatalf("Invalid logging config: %v", err)
 	}
 
 	if len(cfg.Backends) == 0 {
-		log.Fatal("No backends provided in config")
+		logging.Fatalf("No backends provided in config")
+	}
+
+	if cfg.Transparent && !core.TransparentSupported {
+		logging.Fatalf("Transparent mode is only supported on linux")
+	}
+
+	if cfg.SelectionHook != "" && !core.HasSelectionHook(cfg.SelectionHook) {
+		logging.Warnf("Selection hook %q is not registered, using %s only", cfg.SelectionHook, cfg.Algorithm)
 	}
 
 	if strings.TrimSpace(cfg.Port) == "" {
@@ -42,26 +59,33 @@ func main() {
 	}
 
 	// -------------------- init loadbalancer --------------------
-	var backendObjs []*core.Backend
+	backendObjs := make([]*core.Backend, 0, len(cfg.Backends))
 	for _, backend := range cfg.Backends {
-		backendObjs = append(backendObjs,
-			&core.Backend{
-				Address:   backend.Address,
-				IsHealthy: true,
-			})
+		backendObjs = append(backendObjs, core.NewBackend(backend))
 	}
 
+	// a random round robin starting point keeps instances started together
+	// from sending their first connections to the same backends
 	lb := &core.LoadBalancer{
-		Config:          cfg,
-		Algo:            core.ParseAlgorithm(cfg.Algorithm),
-		Backends:        backendObjs,
 		ConnectionCount: 0,
-		Index:           -1,
-		BackendCounts:   make([]int32, len(cfg.Backends)),
-		BackendFails:    make([]int32, len(cfg.Backends)),
-		PathRoutes:      make(map[string]*core.Backend),
+		Index:           mrand.Int31(),
 	}
-	core.StartHealthChecks(lb)
+	lb.SetPool(cfg, backendObjs)
+	metrics.SetAlgorithm(lb.Pool().Algo.String())
+	metrics.EnableExemplars.Store(cfg.MetricsExemplars)
+
+	if *simulate > 0 {
+		runSimulation(os.Stdout, lb, *simulate)
+		return
+	}
+
+	// cancelled on shutdown to stop background work
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	core.Warmup(ctx, lb)
+	healthChecksDone := core.StartHealthChecks(ctx, lb)
+	core.StartStatsLogger(ctx, lb)
 	// -------------------- start listener --------------------
 	listenAddr := net.JoinHostPort(cfg.Host, cfg.Port)
 	var listener net.Listener
@@ -70,142 +94,223 @@ func main() {
 	if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
 		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
 		if err != nil {
-			log.Fatalf("Failed to load TLS cert/key: %v", err)
-		}
-		tlsConfig := &tls.Config{
-			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-				c := currentTLSConfig.Load().(*tls.Certificate)
-				return c, nil
-			},
+			logging.Fatalf("Failed to load TLS cert/key: %v", err)
 		}
-		currentTLSConfig.Store(&cert)
+		tlsConfig := &tls.Config{GetCertificate: config.GetCertificate(lb)}
+		config.CurrentTLSCert.Store(&cert)
 		listener, err = tls.Listen("tcp", listenAddr, tlsConfig)
-		log.Printf("[INFO] TLS listener started on %s", listenAddr)
+		logging.Infof("TLS listener started on %s", listenAddr)
 	} else {
 		listener, err = net.Listen("tcp", listenAddr)
-		log.Printf("[INFO] TCP listener started on %s", listenAddr)
+		logging.Infof("TCP listener started on %s", listenAddr)
 	}
 
 	if err != nil {
-		log.Fatalf("[ERROR] Failed to listen: %v", err)
+		logging.Fatalf("Failed to listen: %v", err)
 	}
 
 	// -------------------- signal handling --------------------
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
-	var shuttingDown atomic.Bool
-	var wg sync.WaitGroup
-	activeConns := sync.Map{}
+	conns := core.NewConnTracker()
 	bufPool := sync.Pool{New: func() interface{} { return make([]byte, 32*1024) }}
+	tieredPool := core.NewTieredPool()
 
+	admin.RegisterHandlers(metrics.Mux, lb)
+	metrics.SetWeightSource(func() []metrics.BackendWeight {
+		var weights []metrics.BackendWeight
+		for _, status := range lb.Snapshot() {
+			weights = append(weights, metrics.BackendWeight{
+				Address:       status.Address,
+				Weight:        status.Weight,
+				CurrentWeight: status.CurrentWeight,
+			})
+		}
+		return weights
+	})
 	metrics.StartMetricsServer(":9100")
-	log.Println("[INFO] Metrics server started on :9100")
+	logging.Infof("Metrics server started on :9100")
+
+	if cfg.PprofAddr != "" {
+		admin.StartPprofServer(cfg.PprofAddr)
+	}
+
+	// serveConn completes the TLS handshake if there is one, connects the
+	// client to a backend and proxies until either side is done. It owns
+	// the conns entry and capacity reservation taken when clientConn was
+	// admitted.
+	serveConn := func(clientConn net.Conn, admitted func()) {
+		if tlsConn, ok := clientConn.(*tls.Conn); ok {
+			if err := handshake(tlsConn, lb.Config().TLSHandshakeTimeout()); err != nil {
+				admitted()
+				// the client is on the event=close line; leaving it out
+				// here lets a handshake flood collapse into one line
+				logging.Limited.Warnf("TLS handshake failed: %v", err)
+				logClose(clientConn, "", core.CloseHandshakeFailed)
+				clientConn.Close()
+				conns.Done(clientConn)
+				return
+			}
+		}
+
+		// -------------------- get backend --------------------
+		backendConn, backend, release, err := lb.DialBackend(clientConn.RemoteAddr().String(), "/")
+		admitted()
+		if err != nil {
+			reason := core.CloseDialFailed
+			if errors.Is(err, core.ErrNoBackend) {
+				reason = core.CloseRejected
+				logging.Limited.Warnf("No backend available, rejecting connections")
+			}
+			logClose(clientConn, "", reason)
+			clientConn.Close()
+			conns.Done(clientConn)
+			return
+		}
+		if lb.Config().ReconnectOnBackendDrop {
+			rc := lb.NewReconnectingConn(backendConn, backend, release, clientConn.RemoteAddr().String())
+			backendConn, release = rc, rc.Release
+		}
+		backendAddr := backend.Address
+		connID := ""
+		if metrics.EnableExemplars.Load() {
+			connID = newConnID()
+		}
+
+		conns.Proxying(clientConn)
+		metrics.PerBackendServed.WithLabelValues(backendAddr).Inc()
+		logging.Infof("Connected client %s -> backend %s", clientConn.RemoteAddr(), backendAddr)
+		if connID != "" {
+			logging.Infof("event=route client=%s backend=%s active_conns=%d conn_id=%s", clientConn.RemoteAddr(), backend.Address, atomic.LoadInt32(&lb.ConnectionCount), connID)
+		} else {
+			logging.Infof("event=route client=%s backend=%s active_conns=%d", clientConn.RemoteAddr(), backend.Address, atomic.LoadInt32(&lb.ConnectionCount))
+		}
+
+		// -------------------- proxy --------------------
+		defer conns.Done(clientConn)
+		defer clientConn.Close()
+		defer backendConn.Close()
+		defer release()
+
+		logging.Debugf("Starting proxy: client=%s backend=%s", clientConn.RemoteAddr(), backendConn.RemoteAddr())
+
+		var stats core.ProxyStats
+		opts := core.ProxyOptions{
+			BufPool:      &bufPool,
+			MaxLifetime:  lb.Config().ConnMaxLifetime.Duration(),
+			IdleTimeout:  lb.Config().IdleTimeout.Duration(),
+			CloseTimeout: lb.Config().GracefulCloseTimeout.Duration(),
+			Stop:         conns.Stop(),
+			Stats:        &stats,
+		}
+		if lb.Config().BufferPool == "tiered" {
+			opts.Buffers = tieredPool
+		}
+		if lb.Config().HTTP2RequestMetrics {
+			requests := metrics.PerBackendHTTP2Requests.WithLabelValues(backendAddr)
+			opts.ClientObserver = core.NewHTTP2RequestCounter(requests.Inc)
+		}
+		start := time.Now()
+		reason := core.Proxy(clientConn, backendConn, opts)
+		if rc, ok := backendConn.(*core.ReconnectingConn); ok {
+			backendAddr = rc.Backend().Address
+		}
+		metrics.ObserveConnection(backendAddr, connID, time.Since(start), stats.FromClient.Load(), stats.FromBackend.Load())
+		if conns.Closing() {
+			reason = core.CloseShutdown
+		}
+		logging.Debugf("Proxy finished: client=%s backend=%s", clientConn.RemoteAddr(), backendConn.RemoteAddr())
+		logClose(clientConn, backendAddr, reason)
+	}
 
 	// -------------------- accept loop --------------------
 	go func() {
 		for {
-			clientConn, err := listener.Accept()
+			if lb.Config().BackpressureAccept && lb.Saturated() {
+				logging.Warnf("All backends at max_conns, pausing accept")
+				if !lb.WaitForCapacity(ctx) {
+					return
+				}
+				logging.Infof("Backend capacity available, resuming accept")
+			}
+
+			clientConn, err := core.Accept(listener)
 			if err != nil {
-				if shuttingDown.Load() {
-					log.Println("[INFO] Listener closed, stopping accept loop")
+				if conns.ShuttingDown() {
+					logging.Infof("Listener closed, stopping accept loop")
 					return
 				}
 				if strings.Contains(err.Error(), "use of closed network connection") {
-					log.Println("[INFO] Listener closed, stopping accept loop")
+					logging.Infof("Listener closed, stopping accept loop")
 					return
 				}
-				log.Printf("[WARN] Accept error: %v", err)
-				continue
-			}
-
-			if shuttingDown.Load() {
-				log.Printf("[INFO] Shutting down, closing new connection: %s", clientConn.RemoteAddr())
-				clientConn.Close()
-				continue
-			}
-
-			wg.Add(1)
-			metrics.ActiveConns.Inc()
-			activeConns.Store(clientConn, struct{}{})
-			log.Printf("[INFO] New client connected: %s", clientConn.RemoteAddr())
-
-			// -------------------- get backend --------------------
-			backend, _, release := lb.GetNextBackend(clientConn.RemoteAddr().String(), "/")
-			if backend == nil {
-				log.Printf("[WARN] No backend available, closing connection %s", clientConn.RemoteAddr())
-				clientConn.Close()
-				wg.Done()
-				activeConns.Delete(clientConn)
+				logging.Limited.Warnf("Accept error: %v", err)
 				continue
 			}
-			backendAddr := backend.Address
 
-			backendConn, err := net.Dial("tcp", backendAddr)
-			if err != nil {
-				log.Printf("[ERROR] Failed to connect backend %s: %v", backendAddr, err)
+			if !conns.Admit(clientConn) {
+				logging.Infof("Shutting down, closing new connection: %s", clientConn.RemoteAddr())
+				logClose(clientConn, "", core.CloseShutdown)
 				clientConn.Close()
-				metrics.PerBackendFails.WithLabelValues(backendAddr).Inc()
-				wg.Done()
-				activeConns.Delete(clientConn)
-				release()
 				continue
 			}
+			logging.Infof("New client connected: %s", clientConn.RemoteAddr())
 
-			activeConns.Store(backendConn, struct{}{})
-			metrics.PerBackendServed.WithLabelValues(backendAddr).Inc()
-			log.Printf("[INFO] Connected client %s -> backend %s", clientConn.RemoteAddr(), backendAddr)
-			log.Printf("event=route client=%s backend=%s active_conns=%d", clientConn.RemoteAddr(), backend.Address, atomic.LoadInt32(&lb.ConnectionCount))
-
-			// -------------------- proxy goroutine --------------------
-			go func(c, b net.Conn, releaseFunc func()) {
-				defer wg.Done()
-				defer c.Close()
-				defer b.Close()
-				defer metrics.ActiveConns.Dec()
-				defer activeConns.Delete(c)
-				defer activeConns.Delete(b)
-				defer releaseFunc()
-
-				log.Printf("[INFO] Starting proxy: client=%s backend=%s", c.RemoteAddr(), b.RemoteAddr())
-
-				var proxyWg sync.WaitGroup
-				proxyWg.Add(2)
-
-				copyFunc := func(dst, src net.Conn) {
-					defer proxyWg.Done()
-					buf := bufPool.Get().([]byte)
-					defer bufPool.Put(buf)
-					n, err := io.CopyBuffer(dst, src, buf)
-					log.Printf("[INFO] %s -> %s copy finished: %d bytes, err=%v", src.RemoteAddr(), dst.RemoteAddr(), n, err)
-					if tcp, ok := dst.(*net.TCPConn); ok {
-						tcp.CloseWrite()
-					}
-					if tcp, ok := src.(*net.TCPConn); ok {
-						tcp.CloseRead()
-					}
-				}
-
-				go copyFunc(b, c)
-				go copyFunc(c, b)
-
-				proxyWg.Wait()
-				log.Printf("[INFO] Proxy finished: client=%s backend=%s", c.RemoteAddr(), b.RemoteAddr())
-			}(clientConn, backendConn, release)
+			go serveConn(clientConn, lb.Admit())
 		}
 	}()
 
 	sig := <-sigCh
-	log.Printf("[INFO] Signal received: %v. Shutting down...", sig)
-	shuttingDown.Store(true)
+	for sig == syscall.SIGHUP {
+		config.ReloadConfig(lb, *configPath)
+		sig = <-sigCh
+	}
+	logging.Infof("Signal received: %v. Shutting down...", sig)
+	conns.Shutdown()
+	cancel()
 	listener.Close()
 
-	activeConns.Range(func(key, _ interface{}) bool {
-		log.Printf("[INFO] Closing active connection: %v", key.(net.Conn).RemoteAddr())
-		key.(net.Conn).Close()
-		return true
-	})
+	// with drain_timeout, let connections finish on their own and only cut
+	// whatever is left once the deadline passes
+	if drainTimeout := lb.Config().DrainTimeout.Duration(); drainTimeout > 0 {
+		logging.Infof("Draining %d connections for up to %s", atomic.LoadInt32(&lb.ConnectionCount), drainTimeout)
+		if conns.WaitDrained(drainTimeout) {
+			logging.Infof("event=drain_complete trigger=connections_zero")
+		} else {
+			logging.Warnf("event=drain_complete trigger=deadline remaining_conns=%d", atomic.LoadInt32(&lb.ConnectionCount))
+			conns.CloseAll()
+		}
+	} else {
+		conns.CloseAll()
+	}
+
+	conns.Wait()
+	<-healthChecksDone
+	logging.Infof("All connections closed. Akash shutdown complete.")
+}
+
+// handshake runs the TLS handshake on conn, giving up after timeout so a
+// client that never finishes it can't hold the connection open.
+func handshake(conn *tls.Conn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
+
+// newConnID returns a random ID used to find a connection's log lines from
+// a metrics exemplar.
+func newConnID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
 
-	wg.Wait()
-	log.Println("[INFO] All connections closed. Akash shutdown complete.")
+// logClose writes the access log line for a finished connection and counts
+// it by close reason.
+func logClose(client net.Conn, backendAddr string, reason core.CloseReason) {
+	logging.Infof("event=close client=%s backend=%s reason=%s", client.RemoteAddr(), backendAddr, reason)
+	metrics.ConnectionClosedTotal.WithLabelValues(string(reason)).Inc()
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"Akash/config"
+	"Akash/core"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestSilentTLSClientClosedAfterHandshakeTimeout connects to a TLS listener
+// without sending a ClientHello and checks the connection is closed once
+// tls_handshake_timeout has passed, the way serveConn handles it.
+func TestSilentTLSClientClosedAfterHandshakeTimeout(t *testing.T) {
+	cfg := &core.UserConfig{Algorithm: "round_robin", HandshakeTimeout: core.Duration(200 * time.Millisecond)}
+	lb := &core.LoadBalancer{}
+	lb.SetPool(cfg, nil)
+	// the handshake never gets as far as asking for the certificate
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: config.GetCertificate(lb)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	handshakeErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			handshakeErr <- err
+			return
+		}
+		err = handshake(conn.(*tls.Conn), cfg.TLSHandshakeTimeout())
+		if err != nil {
+			conn.Close()
+		}
+		handshakeErr <- err
+	}()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	start := time.Now()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("silent client read %v, want the connection closed", err)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("silent client closed after %s, want about the 200ms handshake timeout", elapsed)
+	}
+	if err := <-handshakeErr; err == nil {
+		t.Fatal("handshake with a silent client succeeded")
+	}
+}
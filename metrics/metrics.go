@@ -1,10 +1,14 @@
 package metrics
 
 import (
-	"log"
+	"Akash/logging"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -29,16 +33,156 @@ var (
 		},
 		[]string{"backend"},
 	)
+
+	PerBackendHTTP2Requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "akash_backend_http2_requests_total",
+			Help: "Total HTTP/2 requests seen on connections to each backend",
+		},
+		[]string{"backend"},
+	)
+
+	AlgorithmInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "akash_algorithm_info",
+			Help: "Load balancing algorithm in use; always 1 for the current algorithm",
+		},
+		[]string{"algorithm"},
+	)
+
+	RouteMatchesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "akash_route_matches_total",
+			Help: "Total connections routed by each route rule; default is the algorithm fallthrough",
+		},
+		[]string{"route"},
+	)
+
+	ConnectionClosedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "akash_connections_closed_total",
+			Help: "Total client connections closed, by close reason",
+		},
+		[]string{"reason"},
+	)
+
+	ConnectionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "akash_connection_duration_seconds",
+			Help:    "Lifetime of proxied connections per backend",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 12),
+		},
+		[]string{"backend"},
+	)
+
+	ConnectionBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "akash_connection_bytes",
+			Help:    "Bytes copied per proxied connection; direction is client_to_backend or backend_to_client",
+			Buckets: prometheus.ExponentialBuckets(64, 8, 10),
+		},
+		[]string{"backend", "direction"},
+	)
 )
 
+// EnableExemplars makes ObserveConnection attach the connection ID to its
+// observations as an OpenMetrics exemplar.
+var EnableExemplars atomic.Bool
+
+// ObserveConnection records the duration and byte counts of a finished
+// connection.
+func ObserveConnection(backend, connID string, d time.Duration, fromClient, fromBackend int64) {
+	observe(ConnectionDuration.WithLabelValues(backend), d.Seconds(), connID)
+	observe(ConnectionBytes.WithLabelValues(backend, "client_to_backend"), float64(fromClient), connID)
+	observe(ConnectionBytes.WithLabelValues(backend, "backend_to_client"), float64(fromBackend), connID)
+}
+
+func observe(o prometheus.Observer, v float64, connID string) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && connID != "" && EnableExemplars.Load() {
+		eo.ObserveWithExemplar(v, prometheus.Labels{"connection_id": connID})
+		return
+	}
+	o.Observe(v)
+}
+
+// SetAlgorithm records name as the only algorithm in akash_algorithm_info.
+func SetAlgorithm(name string) {
+	AlgorithmInfo.Reset()
+	AlgorithmInfo.WithLabelValues(name).Set(1)
+}
+
+// Mux is served by the metrics server; other packages can mount
+// operator-facing endpoints on it before StartMetricsServer is called.
+var Mux = http.NewServeMux()
+
+// BackendWeight is the configured and current weight of a single backend.
+type BackendWeight struct {
+	Address       string
+	Weight        int
+	CurrentWeight int
+}
+
+// weightCollector reports akash_backend_weight at scrape time from the
+// registered source, so weights are never stale.
+type weightCollector struct {
+	mu     sync.Mutex
+	source func() []BackendWeight
+	desc   *prometheus.Desc
+}
+
+var weights = &weightCollector{
+	desc: prometheus.NewDesc(
+		"akash_backend_weight",
+		"Weight per backend; kind is configured or current",
+		[]string{"backend", "kind"},
+		nil,
+	),
+}
+
+// SetWeightSource sets the function used to read backend weights at scrape time.
+func SetWeightSource(source func() []BackendWeight) {
+	weights.mu.Lock()
+	weights.source = source
+	weights.mu.Unlock()
+}
+
+func (c *weightCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *weightCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	source := c.source
+	c.mu.Unlock()
+	if source == nil {
+		return
+	}
+
+	for _, w := range source() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(w.Weight), w.Address, "configured")
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(w.CurrentWeight), w.Address, "current")
+	}
+}
+
+// Registry holds every metric served on /metrics, including the Go runtime
+// and process collectors.
+var Registry = prometheus.NewRegistry()
+
 func StartMetricsServer(addr string) {
-	prometheus.MustRegister(ActiveConns, PerBackendServed, PerBackendFails)
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	Registry.MustRegister(ActiveConns, PerBackendServed, PerBackendFails, PerBackendHTTP2Requests, AlgorithmInfo, RouteMatchesTotal, ConnectionClosedTotal, ConnectionDuration, ConnectionBytes, weights)
 
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Printf("[INFO] Prometheus metrics available at %s/metrics", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			log.Printf("[ERROR] Prometheus metrics server error: %v", err)
+		Mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{
+			// exemplars are only exposed in the OpenMetrics format
+			EnableOpenMetrics: true,
+		}))
+		logging.Infof("Prometheus metrics available at %s/metrics", addr)
+		if err := http.ListenAndServe(addr, Mux); err != nil {
+			logging.Errorf("Prometheus metrics server error: %v", err)
 		}
 	}()
 }
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// TestRuntimeMetricsExported scrapes /metrics and checks the Go runtime and
+// process collectors are served next to the Akash metrics.
+func TestRuntimeMetricsExported(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	SetAlgorithm("round_robin")
+	StartMetricsServer(addr)
+
+	var body string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			data, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			body = string(data)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("metrics server never answered: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, name := range []string{"go_goroutines", "go_memstats_heap_alloc_bytes", "process_cpu_seconds_total", "akash_algorithm_info"} {
+		if !strings.Contains(body, "\n"+name) {
+			t.Errorf("/metrics is missing %s", name)
+		}
+	}
+}
+
+// scrapeOpenMetrics returns the connection histograms in OpenMetrics format.
+func scrapeOpenMetrics(t *testing.T) string {
+	t.Helper()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(ConnectionDuration, ConnectionBytes)
+	server := httptest.NewServer(promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	defer server.Close()
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/openmetrics-text")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// TestConnectionExemplars checks that the connection histograms carry the
+// connection ID as an exemplar only while exemplars are enabled.
+func TestConnectionExemplars(t *testing.T) {
+	defer EnableExemplars.Store(false)
+
+	EnableExemplars.Store(true)
+	ObserveConnection("exemplar-on:1", "conn-abc123", 250*time.Millisecond, 100, 5000)
+	EnableExemplars.Store(false)
+	ObserveConnection("exemplar-off:1", "conn-def456", 250*time.Millisecond, 100, 5000)
+
+	body := scrapeOpenMetrics(t)
+	for _, line := range strings.Split(body, "\n") {
+		if strings.Contains(line, "conn-def456") {
+			t.Fatalf("exemplar attached while disabled: %s", line)
+		}
+	}
+	for _, name := range []string{"akash_connection_duration_seconds_bucket", "akash_connection_bytes_bucket"} {
+		found := false
+		for _, line := range strings.Split(body, "\n") {
+			if strings.HasPrefix(line, name+`{backend="exemplar-on:1"`) && strings.Contains(line, `# {connection_id="conn-abc123"}`) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s has no exemplar with the connection ID:\n%s", name, body)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"Akash/core"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// runSimulation routes count synthetic clients through lb without opening
+// any connections and prints to out how many each backend received, so weights and
+// affinity can be checked offline. Every simulated client stays connected
+// until the end, as if they all arrived together.
+func runSimulation(out io.Writer, lb *core.LoadBalancer, count int) {
+	pool := lb.Pool()
+	counts := make(map[*core.Backend]int, len(pool.Backends))
+	var releases []func()
+	unrouted := 0
+
+	for i := 0; i < count; i++ {
+		backend, _, release := lb.GetNextBackend(simulatedClient(i), "/")
+		if backend == nil {
+			unrouted++
+			continue
+		}
+		counts[backend]++
+		releases = append(releases, release)
+	}
+	for _, release := range releases {
+		release()
+	}
+
+	totalWeight := 0
+	for _, b := range pool.Backends {
+		totalWeight += b.Weight
+	}
+
+	fmt.Fprintf(out, "Simulated %d clients with %s\n\n", count, pool.Algo)
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tWEIGHT\tCLIENTS\tSHARE\tWEIGHT SHARE")
+	for _, b := range pool.Backends {
+		weightShare := "-"
+		if totalWeight > 0 {
+			weightShare = fmt.Sprintf("%.1f%%", 100*float64(b.Weight)/float64(totalWeight))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%s\n", b.Address, b.Weight, counts[b], 100*float64(counts[b])/float64(count), weightShare)
+	}
+	w.Flush()
+
+	if unrouted > 0 {
+		fmt.Fprintf(out, "\n%d clients could not be routed\n", unrouted)
+	}
+}
+
+// simulatedClient returns a distinct client address for the i-th client.
+func simulatedClient(i int) string {
+	return fmt.Sprintf("10.%d.%d.%d:%d", (i>>16)&0xff, (i>>8)&0xff, i&0xff, 1024+i%50000)
+}
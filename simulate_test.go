@@ -0,0 +1,41 @@
+package main
+
+import (
+	"Akash/core"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestSimulationReportsWeightedDistribution simulates clients over a
+// weighted pool and checks the printed distribution follows the weights.
+func TestSimulationReportsWeightedDistribution(t *testing.T) {
+	lb := &core.LoadBalancer{}
+	backends := []*core.Backend{
+		core.NewBackend(&core.Backend{Address: "10.0.0.1:80", Weight: 1}),
+		core.NewBackend(&core.Backend{Address: "10.0.0.2:80", Weight: 3}),
+		core.NewBackend(&core.Backend{Address: "10.0.0.3:80", Weight: 0}),
+	}
+	lb.SetPool(&core.UserConfig{Algorithm: "w_round_robin"}, backends)
+
+	var out bytes.Buffer
+	runSimulation(&out, lb, 400)
+
+	report := out.String()
+	for _, want := range []string{
+		"Simulated 400 clients with w_round_robin",
+		"10.0.0.1:80  1       100      25.0%  25.0%",
+		"10.0.0.2:80  3       300      75.0%  75.0%",
+		"10.0.0.3:80  0       0        0.0%   0.0%",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report is missing %q:\n%s", want, report)
+		}
+	}
+	if strings.Contains(report, "could not be routed") {
+		t.Errorf("report has unrouted clients:\n%s", report)
+	}
+	if n := lb.Snapshot()[1].ActiveConnections; n != 0 {
+		t.Fatalf("simulation left %d active connections", n)
+	}
+}